@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"log/slog"
+	"net"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Blocking by IP: blackhole routes for networks from --block-ips, and with
+// --blackhole-blocked for IPs of answers for blocked domains. Covers hardcoded
+// IPs, cached answers and other resolvers, which DNS blocking can't.
+
+var (
+	// Networks from --block-ips and left from previous run
+	blockNets   []*net.IPNet
+	blockNetsMu sync.Mutex
+	// IPs from answers for blocked domains. Not evicted: untracked blackhole
+	// would never be removed, so new IPs are skipped when it's full.
+	blackholeIPset = NewIPv4Set(4096)
+)
+
+func setupBlackholes() {
+	var wanted []*net.IPNet
+	if args.BlockIPs != "" {
+		wanted = readBlockNets()
+	}
+	isWanted := make(map[string]bool, len(wanted))
+	for _, dst := range wanted {
+		isWanted[dst.String()] = true
+	}
+
+	// Left by --persistent or killed process, treated as own. Single IPs are
+	// from answers for blocked domains, unless --block-ips lists them.
+	existing, err := router.Blackholes()
+	if err != nil {
+		log.Fatalf(red("Error:")+" can't read blackhole routes: %v", err)
+	}
+	for _, dst := range existing {
+		if ones, bits := dst.Mask.Size(); ones == bits && !isWanted[dst.String()] {
+			blackholeIPset.Add(dst.IP)
+			blackholeIPset.SetOrigin(dst.IP, "existing")
+		} else {
+			blockNets = append(blockNets, dst)
+		}
+	}
+	if len(existing) > 0 {
+		log.Printf(yellow("Found %d blackhole routes of previous run, will be treated as own."), len(existing))
+	}
+	if args.BlockIPs == "" {
+		return
+	}
+
+	var added []*net.IPNet
+	for _, dst := range wanted {
+		err := router.AddBlackhole(dst)
+		if errors.Is(err, unix.EEXIST) {
+			continue
+		}
+		if err != nil {
+			log.Printf(red("Error:")+" adding blackhole %s: %v", dst, err)
+			continue
+		}
+		added = append(added, dst)
+	}
+	blockNets = append(blockNets, added...)
+	router.FlushConntrack(added)
+	log.Printf("Blackholing %d networks", len(blockNets))
+}
+
+// readBlockNets returns networks of --block-ips, as few as possible
+func readBlockNets() []*net.IPNet {
+	ips, ranges := readPresets(args.BlockIPs)
+	for _, preset := range ips {
+		if preset.ip.To4() == nil {
+			log.Printf(yellow("Skip IPv6 address in %s: ")+"%s", preset.source, preset.ip)
+			continue
+		}
+		v := ipToUint(preset.ip)
+		ranges = append(ranges, ipRange{v, v})
+	}
+	ranges = mergeRanges(ranges)
+	// Blackholed endpoint would break the tunnel
+	wgEndpointIPs.Each(func(ip string, _ RouteInfo) {
+		ranges = excludeIP(ranges, net.ParseIP(ip))
+	})
+	var nets []*net.IPNet
+	for _, r := range ranges {
+		nets = append(nets, r.nets()...)
+	}
+	return nets
+}
+
+func blockNetsContain(ip net.IP) bool {
+	return blockNetFor(ip) != nil
+}
+
+// blockNetFor returns blackholed network containing ip, nil if none
+func blockNetFor(ip net.IP) *net.IPNet {
+	blockNetsMu.Lock()
+	defer blockNetsMu.Unlock()
+	return netContaining(blockNets, ip)
+}
+
+// blackholeAnswer blocks IPs of answer for blocked domain. Addresses shared
+// with proxied domains are left alone.
+func blackholeAnswer(resp *DNSResponse) {
+	var newIPs []net.IP
+	for name, ipList := range resp.ips {
+		for _, ip := range ipList {
+			if wgEndpointIPs.Exists(ip) || proxyIPset.Exists(ip) {
+				continue
+			}
+			added, full := blackholeIPset.TryAdd(ip)
+			if full {
+				slog.Debug("Too many blackholes, IP of blocked domain skipped", "domain", name, "ip", ip)
+				continue
+			}
+			blackholeIPset.Record(ip, name, resp.chain(name))
+			if added {
+				slog.Debug("Blackholing IP of blocked domain", "domain", name, "ip", ip)
+				newIPs = append(newIPs, ip)
+			}
+		}
+	}
+	installRoutes(newIPs, addBlackholeIP, nil)
+}
+
+func addBlackholeIP(ip net.IP) bool {
+	dst := singleHostRoute(ip)
+	err := router.AddBlackhole(dst)
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		log.Printf(red("Error:")+" adding blackhole %s: %v", dst, err)
+		return false
+	}
+	// Proxied by answer processed meanwhile
+	if proxyIPset.Exists(ip) {
+		releaseBlackhole(ip)
+		return false
+	}
+	return true
+}
+
+// releaseBlackhole removes blackhole of blocked domain IP, which is needed by
+// proxied domain too
+func releaseBlackhole(ip net.IP) {
+	if !blackholeIPset.Remove(ip) {
+		return
+	}
+	if err := router.DelBlackhole(singleHostRoute(ip)); err != nil {
+		log.Printf(red("Error:")+" deleting blackhole %s: %v", ip, err)
+		return
+	}
+	slog.Info("Blackhole removed, IP is proxied", "ip", ip)
+}
+
+// protectEndpointBlackholes lets traffic to WireGuard endpoint through
+func protectEndpointBlackholes(ip net.IP) {
+	releaseBlackhole(ip)
+	blockNetsMu.Lock()
+	defer blockNetsMu.Unlock()
+	blockNets = splitNets(blockNets, ip, router.AddBlackhole, router.DelBlackhole)
+}
+
+func cleanupBlackholes() {
+	routeInstalls.Wait()
+	if args.Persistent {
+		return
+	}
+	blockNetsMu.Lock()
+	defer blockNetsMu.Unlock()
+	removed := 0
+	for _, dst := range blockNets {
+		if err := router.DelBlackhole(dst); err != nil {
+			log.Printf(red("Error:")+" deleting blackhole %s: %v", dst, err)
+			continue
+		}
+		removed++
+	}
+	var ips []net.IP
+	blackholeIPset.Each(func(ip string, _ RouteInfo) {
+		ips = append(ips, net.ParseIP(ip))
+	})
+	for _, ip := range ips {
+		if err := router.DelBlackhole(singleHostRoute(ip)); err != nil {
+			log.Printf(red("Error:")+" deleting blackhole %s: %v", ip, err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		slog.Info(green("Blackhole cleanup completed"), "removed", removed)
+	}
+}
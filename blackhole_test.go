@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"testing"
+)
+
+// withBlackholes resets blackhole state on top of withFakeRouter
+func withBlackholes(t *testing.T) *fakeRouter {
+	t.Helper()
+	fake := withFakeRouter(t)
+	savedNets, savedSet := blockNets, blackholeIPset
+	blockNets = nil
+	blackholeIPset = NewIPv4Set(4096)
+	t.Cleanup(func() {
+		blockNets, blackholeIPset = savedNets, savedSet
+	})
+	return fake
+}
+
+func (r *fakeRouter) blackholeList() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []string
+	for dst := range r.blackholes {
+		result = append(result, dst)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// waitBlackholes waits for routes added in background by installRoutes
+func waitBlackholes(r *fakeRouter) []string {
+	routeInstalls.Wait()
+	return r.blackholeList()
+}
+
+func blockedAnswer(name string, ips ...string) *DNSResponse {
+	resp := &DNSResponse{question: name, ips: map[string][]net.IP{}}
+	for _, ip := range ips {
+		resp.ips[name] = append(resp.ips[name], net.ParseIP(ip))
+	}
+	return resp
+}
+
+func TestBlackholeReleasedForProxiedIP(t *testing.T) {
+	fake := withBlackholes(t)
+	shared := net.ParseIP("5.5.5.5")
+
+	blackholeAnswer(blockedAnswer("ads.example", "5.5.5.5", "6.6.6.6"))
+	if got := waitBlackholes(fake); len(got) != 2 {
+		t.Fatalf("blackholes = %v, want 2", got)
+	}
+
+	// Proxied domain on the same CDN address
+	proxyIPset.Add(shared)
+	addProxyRoute(shared)
+
+	if got, want := fake.blackholeList(), []string{"6.6.6.6/32"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("blackholes = %v, want %v", got, want)
+	}
+	if blackholeIPset.Exists(shared) {
+		t.Error("released IP is still tracked as blackhole")
+	}
+	if routes, _ := fake.Routes(); len(routes) != 1 || !routes[0].Equal(shared) {
+		t.Errorf("routes = %v, want [%s]", routes, shared)
+	}
+
+	// Later answer for blocked domain doesn't take it back
+	blackholeAnswer(blockedAnswer("ads.example", "5.5.5.5"))
+	if got := waitBlackholes(fake); len(got) != 1 {
+		t.Errorf("blackholes = %v, proxied IP blackholed again", got)
+	}
+}
+
+func TestBlackholesFoundAfterRestart(t *testing.T) {
+	fake := withBlackholes(t)
+	args.Persistent = true
+	args.BlockIPs = writePresets(t, "10.0.0.0/24\n")
+
+	setupBlackholes()
+	blackholeAnswer(blockedAnswer("ads.example", "5.5.5.5"))
+	waitBlackholes(fake)
+	cleanupBlackholes()
+	if got := fake.blackholeList(); len(got) != 2 {
+		t.Fatalf("blackholes = %v, --persistent should keep them", got)
+	}
+
+	// Next run without --persistent and --block-ips
+	blockNets = nil
+	blackholeIPset = NewIPv4Set(4096)
+	args.Persistent = false
+	args.BlockIPs = ""
+
+	setupBlackholes()
+	if !blackholeIPset.Exists(net.ParseIP("5.5.5.5")) {
+		t.Error("blackhole of previous run is not tracked")
+	}
+	if !blockNetsContain(net.ParseIP("10.0.0.1")) {
+		t.Error("blocked network of previous run is not tracked")
+	}
+	cleanupBlackholes()
+	if got := fake.blackholeList(); len(got) != 0 {
+		t.Errorf("blackholes = %v left after cleanup", got)
+	}
+}
+
+func TestBlockedIPFoundAfterRestart(t *testing.T) {
+	fake := withBlackholes(t)
+	blocked := net.ParseIP("1.2.3.4")
+	// Left by --persistent run with the same --block-ips
+	fake.blackholes["1.2.3.4/32"] = singleHostRoute(blocked)
+	args.BlockIPs = writePresets(t, "1.2.3.4\n")
+
+	setupBlackholes()
+	if !blockNetsContain(blocked) {
+		t.Fatal("blocked IP of previous run is not in blocked networks")
+	}
+	if blackholeIPset.Exists(blocked) {
+		t.Error("blocked IP is tracked as IP of blocked domain")
+	}
+
+	// Proxied answer must not unblock it
+	releaseBlackhole(blocked)
+	if got := fake.blackholeList(); len(got) != 1 || got[0] != "1.2.3.4/32" {
+		t.Errorf("blackholes = %v, want [1.2.3.4/32]", got)
+	}
+}
+
+func TestBlackholeSkipsWhenFull(t *testing.T) {
+	fake := withBlackholes(t)
+	blackholeIPset = NewIPv4Set(1)
+
+	blackholeAnswer(blockedAnswer("ads.example", "5.5.5.5"))
+	waitBlackholes(fake)
+	blackholeAnswer(blockedAnswer("ads.example", "6.6.6.6"))
+	waitBlackholes(fake)
+
+	// Eviction would leave untracked route behind
+	if !blackholeIPset.Exists(net.ParseIP("5.5.5.5")) {
+		t.Error("tracked blackhole evicted")
+	}
+	if got := fake.blackholeList(); len(got) != 1 || got[0] != "5.5.5.5/32" {
+		t.Errorf("blackholes = %v, want [5.5.5.5/32]", got)
+	}
+}
+
+func TestEndpointSplitsBlockedNetwork(t *testing.T) {
+	fake := withBlackholes(t)
+	args.BlockIPs = writePresets(t, "10.0.0.0/30\n")
+	setupBlackholes()
+
+	endpoint := net.ParseIP("10.0.0.1")
+	protectEndpointBlackholes(endpoint)
+
+	if blockNetsContain(endpoint) {
+		t.Error("endpoint is still in blocked networks")
+	}
+	want := []string{"10.0.0.0/32", "10.0.0.2/31"}
+	if got := fake.blackholeList(); len(got) != 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("blackholes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+)
+
+type CheckArgs struct {
+	Domains []string `arg:"positional,required" help:"Domains to check"`
+}
+
+// checkCommand explains what dnsr would do with answers for given domains
+func checkCommand(argv []string) {
+	var checkArgs CheckArgs
+	parser, err := arg.NewParser(arg.Config{Program: "dnsr check"}, &checkArgs, &args.ListArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parser.MustParse(argv)
+
+	loadLists()
+	fmt.Println("====================")
+
+	for _, name := range checkArgs.Domains {
+		name = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+		key := trimDomain(name)
+		fmt.Println(name)
+		fmt.Printf("  key:     %s\n", key)
+
+		// Same order as in processPacket: block wins over proxy
+		if rule := blockRule(name); rule != "" {
+			fmt.Printf("  verdict: %s\n", red("block"))
+			printListEntry(args.BlockList, func(domain string) bool {
+				return domain == rule
+			})
+		} else if _, proxied := proxiedDomains[key]; proxied {
+			fmt.Printf("  verdict: %s\n", green("proxy"))
+			printListEntry(args.ProxyList, func(domain string) bool {
+				domain = strings.TrimPrefix(domain, ".")
+				return !isPattern(domain) && !isRegexRule(domain) && trimDomain(domain) == key
+			})
+		} else if rule := proxyRule(name); rule != "" {
+			fmt.Printf("  verdict: %s\n", green("proxy"))
+			printListEntry(args.ProxyList, func(domain string) bool {
+				// Plain domains of proxy list are suffixes too
+				return domain == rule || "."+domain == rule
+			})
+		} else {
+			fmt.Printf("  verdict: direct\n")
+		}
+	}
+}
+
+func printListEntry(sources string, match func(domain string) bool) {
+	entry := findListEntry(sources, match)
+	if entry == nil {
+		return
+	}
+	fmt.Printf("  matched: %s:%d  %s\n", entry.source, entry.line, entry.domain)
+}
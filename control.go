@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/alexflint/go-arg"
+)
+
+// Running dnsr answers queries about its state on a unix socket.
+// Protocol is one text line request, text response until connection is closed.
+
+type ControlArgs struct {
+	Control string `arg:"--control" default:"/var/run/dnsr.sock" help:"Control socket for status queries, empty to disable"`
+}
+
+var controlListener net.Listener
+
+func startControl() {
+	if args.Control == "" {
+		return
+	}
+	if err := removeStaleSocket(args.Control); err != nil {
+		log.Printf(yellow("Can't open control socket: ")+"%v", err)
+		return
+	}
+
+	var err error
+	controlListener, err = net.Listen("unix", args.Control)
+	if err != nil {
+		log.Printf(yellow("Can't open control socket: ")+"%v", err)
+		return
+	}
+	// Requests only read state, status and why work for any user regardless
+	// of umask
+	if err := os.Chmod(args.Control, 0666); err != nil {
+		log.Printf(yellow("Can't open control socket: ")+"%v", err)
+		controlListener.Close()
+		controlListener = nil
+		return
+	}
+	go func() {
+		for {
+			conn, err := controlListener.Accept()
+			if err != nil {
+				return
+			}
+			go handleControl(conn)
+		}
+	}()
+}
+
+// removeStaleSocket removes socket left from killed process. Anything else at
+// the path is left alone, it may be a mistyped option.
+func removeStaleSocket(path string) error {
+	stat, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+func stopControl() {
+	if controlListener != nil {
+		controlListener.Close()
+	}
+}
+
+func handleControl(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	request, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(request)
+	if len(fields) == 0 {
+		return
+	}
+	w := bufio.NewWriter(conn)
+	defer w.Flush()
+
+	switch fields[0] {
+	case "why":
+		for _, arg := range fields[1:] {
+			ip := net.ParseIP(arg)
+			if ip == nil || ip.To4() == nil {
+				fmt.Fprintf(w, "%s: not an IPv4 address\n", arg)
+				continue
+			}
+			writeWhy(w, ip)
+		}
+	case "status":
+		writeStatus(w)
+	default:
+		fmt.Fprintf(w, "unknown request: %s\n", fields[0])
+	}
+}
+
+// writeWhy explains route of ip: own route, preset network or blackhole
+func writeWhy(w io.Writer, ip net.IP) {
+	if info, exists := proxyIPset.Info(ip); exists {
+		writeRouteInfo(w, ip.String(), info)
+	} else if info, exists := blackholeIPset.Info(ip); exists {
+		writeRouteInfo(w, ip.String()+" (blackhole)", info)
+	} else if dst := presetNetFor(ip); dst != nil {
+		fmt.Fprintf(w, "%s: routed by preset network %s\n", ip, dst)
+	} else if dst := blockNetFor(ip); dst != nil {
+		fmt.Fprintf(w, "%s: blackholed by network %s\n", ip, dst)
+	} else {
+		fmt.Fprintf(w, "%s: not routed by dnsr\n", ip)
+	}
+}
+
+func writeRouteInfo(w io.Writer, ip string, info RouteInfo) {
+	fmt.Fprintln(w, ip)
+	fmt.Fprintf(w, "  origin:     %s\n", info.Origin)
+	if len(info.Domains) > 0 {
+		fmt.Fprintf(w, "  domains:    %s\n", strings.Join(info.Domains, ", "))
+	}
+	if len(info.CNAMEs) > 0 {
+		fmt.Fprintf(w, "  cnames:     %s\n", strings.Join(info.CNAMEs, " -> "))
+	}
+	fmt.Fprintf(w, "  first seen: %s\n", info.FirstSeen.Format(time.DateTime))
+	fmt.Fprintf(w, "  last seen:  %s\n", info.LastSeen.Format(time.DateTime))
+	fmt.Fprintf(w, "  hits:       %d\n", info.Hits)
+}
+
+func writeStatus(w io.Writer) {
+	// Slow client must not hold the set locked, so copy first
+	type route struct {
+		ip   string
+		info RouteInfo
+	}
+	var routes []route
+	proxyIPset.Each(func(ip string, info RouteInfo) {
+		routes = append(routes, route{ip, info})
+	})
+	blocked := blackholeIPset.Len()
+
+	origins := make(map[string]int)
+	for _, route := range routes {
+		origins[originKind(route.info.Origin)]++
+	}
+	fmt.Fprintf(w, "Routes: %d (dns %d, preset %d, existing %d)\n",
+		len(routes), origins["dns"], origins["preset"], origins["existing"])
+	presetNetsMu.Lock()
+	nets := len(presetNets)
+	presetNetsMu.Unlock()
+	if nets > 0 {
+		fmt.Fprintf(w, "Preset networks: %d\n", nets)
+	}
+	blockNetsMu.Lock()
+	blockedNets := len(blockNets)
+	blockNetsMu.Unlock()
+	if blockedNets > 0 || blocked > 0 || args.BlackholeBlocked {
+		fmt.Fprintf(w, "Blackholes: %d networks, %d IPs of blocked domains\n", blockedNets, blocked)
+	}
+	if passiveMode() {
+		fmt.Fprintf(w, "Injected answers ignored: %d\n", injectedIgnored.Load())
+	} else {
+		fmt.Fprintf(w, "Injected answers dropped: %d\n", injectedCount.Load())
+	}
+	for _, route := range routes {
+		fmt.Fprintf(w, "%-15s  %-8s  hits %-5d  %s\n", route.ip, originKind(route.info.Origin),
+			route.info.Hits, strings.Join(route.info.Domains, ", "))
+	}
+}
+
+// "preset /etc/dns-ips.txt" -> "preset"
+func originKind(origin string) string {
+	kind, _, _ := strings.Cut(origin, " ")
+	return kind
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+type WhyArgs struct {
+	IPs []string `arg:"positional,required" help:"Routed IP addresses"`
+	ControlArgs
+}
+
+// whyCommand asks running dnsr which DNS answers created routes
+func whyCommand(argv []string) {
+	var whyArgs WhyArgs
+	parser, err := arg.NewParser(arg.Config{Program: "dnsr why"}, &whyArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parser.MustParse(argv)
+	controlRequest(whyArgs.Control, "why "+strings.Join(whyArgs.IPs, " "))
+}
+
+type StatusArgs struct {
+	ControlArgs
+}
+
+// statusCommand shows routes of running dnsr
+func statusCommand(argv []string) {
+	var statusArgs StatusArgs
+	parser, err := arg.NewParser(arg.Config{Program: "dnsr status"}, &statusArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parser.MustParse(argv)
+	controlRequest(statusArgs.Control, "status")
+}
+
+func controlRequest(socket, request string) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		log.Fatalf(red("Error:")+" connecting to dnsr: %v", err)
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintln(conn, request); err != nil {
+		log.Fatalf(red("Error:")+" sending request: %v", err)
+	}
+	if _, err := io.Copy(os.Stdout, conn); err != nil {
+		log.Fatalf(red("Error:")+" reading response: %v", err)
+	}
+}
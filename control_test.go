@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestWhy(t *testing.T) {
+	withBlackholes(t)
+	_, preset, _ := net.ParseCIDR("10.0.0.0/24")
+	_, blocked, _ := net.ParseCIDR("10.1.0.0/24")
+	presetNets = []*net.IPNet{preset}
+	blockNets = []*net.IPNet{blocked}
+	proxyIPset.Add(net.ParseIP("1.1.1.1"))
+	proxyIPset.Record(net.ParseIP("1.1.1.1"), "proxied.com", nil)
+	blackholeIPset.Add(net.ParseIP("5.5.5.5"))
+	blackholeIPset.Record(net.ParseIP("5.5.5.5"), "ads.example", nil)
+
+	tests := []struct {
+		ip, want string
+	}{
+		{"1.1.1.1", "domains:    proxied.com"},
+		{"5.5.5.5", "5.5.5.5 (blackhole)"},
+		{"10.0.0.7", "routed by preset network 10.0.0.0/24"},
+		{"10.1.0.7", "blackholed by network 10.1.0.0/24"},
+		{"8.8.8.8", "not routed by dnsr"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		writeWhy(&out, net.ParseIP(tt.ip))
+		if !strings.Contains(out.String(), tt.want) {
+			t.Errorf("why %s = %q, want %q", tt.ip, out.String(), tt.want)
+		}
+	}
+}
+
+func TestControlSocketMode(t *testing.T) {
+	saved := args
+	t.Cleanup(func() { args = saved })
+	args.Control = filepath.Join(t.TempDir(), "dnsr.sock")
+	// Restrictive umask must not hide status from other users
+	old := unix.Umask(0077)
+	startControl()
+	unix.Umask(old)
+	defer stopControl()
+
+	stat, err := os.Stat(args.Control)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := stat.Mode().Perm(); mode != 0666 {
+		t.Errorf("socket mode = %o, want 666", mode)
+	}
+}
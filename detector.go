@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Detector of blocked sites. Direct DNS answers are remembered, then conntrack
+// is polled for TCP connections to these IPs which were reset or never
+// completed the handshake. Domain with enough such failures is either written
+// to suggestions file or proxied for a while.
+
+const (
+	detectInterval = 5 * time.Second
+	// Failed connections before domain is considered blocked
+	detectThreshold = 3
+	// Conntrack TCP states, see linux/netfilter/nf_conntrack_tcp.h
+	tcpConntrackSynSent = 1
+	tcpConntrackClose   = 8
+)
+
+type blockCandidate struct {
+	failures int
+	reasons  map[string]int
+	ips      map[string]struct{}
+	reported bool
+}
+
+type blockDetector struct {
+	mu sync.Mutex
+	// Recent direct answers
+	answers *IPv4Set
+	// Flow -> number of polls seen in SYN_SENT, -1 for already counted flows
+	flows      map[string]int
+	candidates map[string]*blockCandidate
+	// Learned domain -> expiration
+	learned map[string]time.Time
+	// Already in suggestions file
+	suggested map[string]struct{}
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+var detector *blockDetector
+
+func startDetector() {
+	switch args.Detect {
+	case "":
+		return
+	case "suggest", "learn":
+	default:
+		log.Fatalf(red("Unknown --detect mode: ")+"%s", args.Detect)
+	}
+
+	detector = &blockDetector{
+		answers:    NewIPv4Set(4096),
+		flows:      make(map[string]int),
+		candidates: make(map[string]*blockCandidate),
+		learned:    make(map[string]time.Time),
+		suggested:  make(map[string]struct{}),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	if args.Detect == "suggest" && fileExists(args.Suggestions) {
+		readDomains(args.Suggestions, func(domain string) {
+			detector.suggested[domain] = struct{}{}
+		})
+	}
+	if _, err := nl.ConntrackTableList(netlink.ConntrackTable, netlink.FAMILY_V4); err != nil {
+		log.Fatalf(red("Error:")+" reading conntrack table: %v", err)
+	}
+	go detector.run()
+	log.Printf("Detecting blocked sites, mode: %s", args.Detect)
+}
+
+// noteDirect remembers answer for not proxied domain
+func (d *blockDetector) noteDirect(name string, ipList []net.IP) {
+	for _, ip := range ipList {
+		d.answers.Add(ip)
+		d.answers.Record(ip, name, nil)
+	}
+}
+
+func (d *blockDetector) run() {
+	defer close(d.done)
+	ticker := time.NewTicker(detectInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.poll()
+			d.expire()
+		}
+	}
+}
+
+// stopDetector waits for the current poll, so routes don't change during cleanup
+func stopDetector() {
+	if detector == nil {
+		return
+	}
+	close(detector.stop)
+	<-detector.done
+}
+
+func (d *blockDetector) poll() {
+	flows, err := nl.ConntrackTableList(netlink.ConntrackTable, netlink.FAMILY_V4)
+	if err != nil {
+		slog.Warn("Can't read conntrack table", "err", err)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	seen := make(map[string]struct{})
+	for _, flow := range flows {
+		if flow.Forward.Protocol != unix.IPPROTO_TCP {
+			continue
+		}
+		tcp, ok := flow.ProtoInfo.(*netlink.ProtoInfoTCP)
+		if !ok {
+			continue
+		}
+		dst := flow.Forward.DstIP
+		if proxyIPset.Exists(dst) || wgEndpointIPs.Exists(dst) {
+			continue
+		}
+		info, ok := d.answers.Info(dst)
+		if !ok || len(info.Domains) == 0 {
+			continue
+		}
+
+		key := fmt.Sprintf("%s:%d-%s:%d", flow.Forward.SrcIP, flow.Forward.SrcPort, dst, flow.Forward.DstPort)
+		seen[key] = struct{}{}
+		if d.flows[key] < 0 {
+			continue
+		}
+		switch tcp.State {
+		case tcpConntrackSynSent:
+			// Seen twice means no answer for at least one poll interval
+			d.flows[key]++
+			if d.flows[key] >= 2 {
+				d.flows[key] = -1
+				d.failure(info.Domains[0], dst, "timeout")
+			}
+		case tcpConntrackClose:
+			// Normal close goes through FIN states, CLOSE means RST
+			d.flows[key] = -1
+			d.failure(info.Domains[0], dst, "reset")
+		}
+	}
+	for key := range d.flows {
+		if _, exists := seen[key]; !exists {
+			delete(d.flows, key)
+		}
+	}
+}
+
+func (d *blockDetector) failure(name string, ip net.IP, reason string) {
+	if isProxied(name) {
+		return
+	}
+	key := trimDomain(name)
+	c, exists := d.candidates[key]
+	if !exists {
+		c = &blockCandidate{reasons: make(map[string]int), ips: make(map[string]struct{})}
+		d.candidates[key] = c
+	}
+	c.failures++
+	c.reasons[reason]++
+	c.ips[ip.String()] = struct{}{}
+	slog.Debug("Failed direct connection", "domain", name, "ip", ip, "reason", reason, "failures", c.failures)
+	if c.failures < detectThreshold || c.reported {
+		return
+	}
+	c.reported = true
+
+	if args.Detect == "learn" {
+		d.learn(key, name, ip, c)
+	} else {
+		d.suggest(key, c)
+	}
+}
+
+func (d *blockDetector) suggest(key string, c *blockCandidate) {
+	if _, exists := d.suggested[key]; exists {
+		return
+	}
+	d.suggested[key] = struct{}{}
+	slog.Info(yellow("Blocked site suspected"), "domain", key, "failures", c.failures, "evidence", c.evidence())
+
+	file, err := os.OpenFile(args.Suggestions, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		slog.Error("Can't write suggestions", "file", args.Suggestions, "err", err)
+		return
+	}
+	defer file.Close()
+	fmt.Fprintf(file, "%s  # %s, %s\n", key, c.evidence(), time.Now().Format(time.DateTime))
+}
+
+func (d *blockDetector) learn(key, name string, ip net.IP, c *blockCandidate) {
+	d.learned[key] = time.Now().Add(args.LearnTTL)
+	learnProxiedDomain(key)
+	slog.Info(yellow("Blocked site learned"), "domain", key, "failures", c.failures,
+		"evidence", c.evidence(), "ttl", args.LearnTTL)
+
+	// Don't wait for the next DNS answer. More specific route would bypass
+	// --block-ips.
+	if blockNetsContain(ip) {
+		return
+	}
+	added, _ := claimRoute(ip)
+	proxyIPset.Record(ip, name, nil)
+	if added {
+		proxyIPset.SetOrigin(ip, "learned")
+		installRoutes([]net.IP{ip}, addProxyRoute, nil)
+	}
+}
+
+func (d *blockDetector) expire() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for key, expiration := range d.learned {
+		if now.After(expiration) {
+			delete(d.learned, key)
+			delete(d.candidates, key)
+			forgetProxiedDomain(key)
+			removed := forgetLearnedRoutes(key)
+			slog.Info("Learned domain expired", "domain", key, "routes", removed)
+		}
+	}
+}
+
+// forgetLearnedRoutes removes routes which were added for expired domain only.
+// Addresses shared with still proxied domains, preset and existing ones stay.
+func forgetLearnedRoutes(key string) int {
+	var stale []net.IP
+	proxyIPset.Each(func(ip string, info RouteInfo) {
+		if origin := originKind(info.Origin); origin != "learned" && origin != "dns" {
+			return
+		}
+		learned := false
+		for _, domain := range info.Domains {
+			if isProxied(domain) {
+				return
+			}
+			if trimDomain(domain) == key {
+				learned = true
+			}
+		}
+		if learned {
+			stale = append(stale, net.ParseIP(ip))
+		}
+	})
+	var removed []net.IP
+	for _, ip := range stale {
+		if delRoute(ip) {
+			removed = append(removed, ip)
+		}
+		proxyIPset.Remove(ip)
+	}
+	router.FlushConntrack(singleHostRoutes(removed))
+	return len(stale)
+}
+
+// "3 failures (reset 2, timeout 1) to 1.2.3.4"
+func (c *blockCandidate) evidence() string {
+	var reasons, ips []string
+	for reason, count := range c.reasons {
+		reasons = append(reasons, fmt.Sprintf("%s %d", reason, count))
+	}
+	for ip := range c.ips {
+		ips = append(ips, ip)
+	}
+	sort.Strings(reasons)
+	sort.Strings(ips)
+	return fmt.Sprintf("%d failures (%s) to %s", c.failures, strings.Join(reasons, ", "), strings.Join(ips, " "))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLearnedDomainExpiry(t *testing.T) {
+	fake := withFakeRouter(t)
+	savedDomains := proxiedDomains
+	proxiedDomains = map[string]struct{}{"shared.com": {}}
+	t.Cleanup(func() { proxiedDomains = savedDomains })
+	args.Detect = "learn"
+	args.LearnTTL = time.Hour
+
+	d := &blockDetector{
+		candidates: make(map[string]*blockCandidate),
+		learned:    make(map[string]time.Time),
+	}
+	learnedIP := net.ParseIP("1.1.1.1")
+	c := &blockCandidate{reasons: map[string]int{"reset": 3}, ips: map[string]struct{}{}}
+	d.learn("blocked.com", "www.blocked.com", learnedIP, c)
+
+	// Later answers while the domain is learned
+	for _, answer := range []struct{ ip, domain string }{
+		{"2.2.2.2", "cdn.blocked.com"},
+		{"3.3.3.3", "shared.com"},
+	} {
+		ip := net.ParseIP(answer.ip)
+		proxyIPset.Add(ip)
+		proxyIPset.Record(ip, answer.domain, nil)
+		addRoute(ip)
+	}
+	proxyIPset.Record(net.ParseIP("3.3.3.3"), "blocked.com", nil)
+
+	// learn() adds route in background
+	routeInstalls.Wait()
+
+	d.learned["blocked.com"] = time.Now().Add(-time.Second)
+	d.expire()
+
+	if isProxied("www.blocked.com") {
+		t.Error("expired domain is still proxied")
+	}
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2"} {
+		if proxyIPset.Exists(net.ParseIP(ip)) {
+			t.Errorf("route to %s of expired domain is still tracked", ip)
+		}
+	}
+	routes, _ := fake.Routes()
+	if len(routes) != 1 || !routes[0].Equal(net.ParseIP("3.3.3.3")) {
+		t.Errorf("routes = %v, want only shared 3.3.3.3", routes)
+	}
+}
+
+func TestLearnUsesRoutePath(t *testing.T) {
+	fake := withBlackholes(t)
+	savedDomains := proxiedDomains
+	proxiedDomains = map[string]struct{}{}
+	t.Cleanup(func() { proxiedDomains = savedDomains })
+	args.Detect = "learn"
+	args.LearnTTL = time.Hour
+	_, blocked, _ := net.ParseCIDR("10.1.0.0/24")
+	blockNets = []*net.IPNet{blocked}
+	blackholed := net.ParseIP("5.5.5.5")
+	blackholeIPset.Add(blackholed)
+	fake.AddBlackhole(singleHostRoute(blackholed))
+
+	d := &blockDetector{
+		candidates: make(map[string]*blockCandidate),
+		learned:    make(map[string]time.Time),
+	}
+	c := &blockCandidate{reasons: map[string]int{"reset": 3}, ips: map[string]struct{}{}}
+	d.learn("shared.com", "shared.com", blackholed, c)
+	d.learn("blocked.net", "blocked.net", net.ParseIP("10.1.0.5"), c)
+	routeInstalls.Wait()
+
+	routes, _ := fake.Routes()
+	if len(routes) != 1 || !routes[0].Equal(blackholed) {
+		t.Errorf("routes = %v, want [%s]", routes, blackholed)
+	}
+	if got := fake.blackholeList(); len(got) != 0 {
+		t.Errorf("blackholes = %v, learned IP should be released", got)
+	}
+}
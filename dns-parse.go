@@ -3,16 +3,50 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
 
 	"golang.org/x/net/dns/dnsmessage"
 )
 
-type ResolvedName struct {
-	name string
-	ip   net.IP
+// Parsed DNS answer
+type DNSResponse struct {
+	question string
+	// Question type, e.g. "AAAA"
+	qtype string
+	// Error code, empty for NOERROR
+	rcode string
+	// IPs by name. Aliases get IPs of their CNAME targets too.
+	ips map[string][]net.IP
+	// alias -> target
+	cnames map[string]string
+	// Smallest TTL of A and CNAME records
+	minTTL uint32
+}
+
+// chain returns CNAME chain starting from name, without name itself
+func (r *DNSResponse) chain(name string) []string {
+	var result []string
+	for target, ok := r.cnames[name]; ok && len(result) < len(r.cnames); target, ok = r.cnames[target] {
+		result = append(result, target)
+	}
+	return result
+}
+
+// rcodeName returns error code as dig shows it, empty for NOERROR
+func rcodeName(rcode dnsmessage.RCode) string {
+	switch rcode {
+	case dnsmessage.RCodeSuccess:
+		return ""
+	case dnsmessage.RCodeNameError:
+		return "NXDOMAIN"
+	case dnsmessage.RCodeServerFailure:
+		return "SERVFAIL"
+	case dnsmessage.RCodeRefused:
+		return "REFUSED"
+	}
+	return strings.TrimPrefix(rcode.String(), "RCode")
 }
 
 // extractUDPayload извлекает полезную нагрузку из IP пакета
@@ -66,14 +100,28 @@ func extractUdpPayload(packet []byte) ([]byte, error) {
 	return dnsPayload, nil
 }
 
-func parseDNSResponse(dnsPayload []byte) map[string][]net.IP {
-	result := make(map[string][]net.IP)
+// packetDst returns destination of IPv4 packet, i.e. client for DNS answer
+func packetDst(packet []byte) net.IP {
+	if len(packet) < 20 {
+		return nil
+	}
+	return net.IP(append([]byte(nil), packet[16:20]...))
+}
+
+func parseDNSResponse(dnsPayload []byte) *DNSResponse {
+	response := &DNSResponse{
+		ips:    make(map[string][]net.IP),
+		cnames: make(map[string]string),
+	}
+	result := response.ips
 	var parser dnsmessage.Parser
 
-	if _, err := parser.Start(dnsPayload); err != nil {
-		fmt.Println("Failed to parse DNS message:", err)
-		return result
+	header, err := parser.Start(dnsPayload)
+	if err != nil {
+		slog.Warn("Failed to parse DNS message", "err", err)
+		return response
 	}
+	response.rcode = rcodeName(header.RCode)
 
 	// Question parsing
 	var requestedName string
@@ -83,22 +131,27 @@ func parseDNSResponse(dnsPayload []byte) map[string][]net.IP {
 			break
 		}
 		requestedName = qq.Name.String()
+		response.qtype = strings.TrimPrefix(qq.Type.String(), "Type")
 		if err != nil {
-			fmt.Println("Failed to parse Question:", err)
-			return result
+			slog.Warn("Failed to parse Question", "err", err)
+			return response
 		}
 	}
 
 	// Store all answers to process them later
 	answers, err := parser.AllAnswers()
 	if err != nil {
-		fmt.Println("Failed to parse DNSAnswers:", err)
-		return result
+		slog.Warn("Failed to parse DNSAnswers", "domain", requestedName, "err", err)
+		return response
 	}
 
 	// First collect all CNAME records
-	cnameMap := make(map[string]string)
-	for _, rr := range answers {
+	response.question = strings.ToLower(strings.TrimSuffix(requestedName, "."))
+	cnameMap := response.cnames
+	for i, rr := range answers {
+		if i == 0 || rr.Header.TTL < response.minTTL {
+			response.minTTL = rr.Header.TTL
+		}
 		if rr.Header.Type == dnsmessage.TypeCNAME {
 			if cname, ok := rr.Body.(*dnsmessage.CNAMEResource); ok {
 				name := strings.ToLower(strings.TrimSuffix(rr.Header.Name.String(), "."))
@@ -128,8 +181,8 @@ func parseDNSResponse(dnsPayload []byte) map[string][]net.IP {
 		}
 	}
 
-	if args.Verbose && len(result) == 0 {
-		log.Print("Empty/Useless DNS-answer for ", requestedName)
+	if len(result) == 0 {
+		slog.Debug("Empty/Useless DNS-answer", "domain", response.question)
 	}
-	return result
+	return response
 }
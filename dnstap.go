@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// dnstap input: resolver (unbound, dnsmasq, knot...) sends its answers over
+// Frame Streams to a unix socket. Answers go to the same decision logic as
+// intercepted packets, but can't be blocked, the client already has them.
+
+// Frame Streams control frames, see
+// https://farsightsec.github.io/fstrm/fstrm_8h.html
+const (
+	fstrmControlAccept = 0x01
+	fstrmControlStart  = 0x02
+	fstrmControlStop   = 0x03
+	fstrmControlReady  = 0x04
+	fstrmControlFinish = 0x05
+
+	fstrmFieldContentType = 0x01
+
+	fstrmMaxFrame = 1 << 20
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// dnstap.proto field numbers
+const (
+	dnstapFieldMessage = 14
+	dnstapFieldType    = 15
+	dnstapTypeMessage  = 1
+
+	dnstapMessageType            = 1
+	dnstapMessageQueryAddress    = 4
+	dnstapMessageResponseMessage = 14
+
+	dnstapResolverResponse  = 4
+	dnstapClientResponse    = 6
+	dnstapForwarderResponse = 8
+	dnstapStubResponse      = 10
+)
+
+var dnstapListener net.Listener
+
+func startDnstap() {
+	log.Print(yellow("dnstap mode: answers are read from resolver, not intercepted."))
+	log.Print(yellow("Blocking and dropping of injected answers are not available."))
+
+	if err := removeStaleSocket(args.Dnstap); err != nil {
+		log.Fatalf(red("Error:")+" opening dnstap socket: %v", err)
+	}
+	var err error
+	dnstapListener, err = net.Listen("unix", args.Dnstap)
+	if err != nil {
+		log.Fatalf(red("Error:")+" opening dnstap socket: %v", err)
+	}
+	// Answers written here create routes, so only root and the resolver may
+	// write. Resolvers usually drop privileges and run as own user.
+	if err := os.Chmod(args.Dnstap, 0660); err != nil {
+		log.Fatalf(red("Error:")+" opening dnstap socket: %v", err)
+	}
+	if args.DnstapGroup != "" {
+		gid, err := lookupGroup(args.DnstapGroup)
+		if err != nil {
+			log.Fatalf(red("Error:")+" dnstap socket group: %v", err)
+		}
+		if err := os.Chown(args.Dnstap, -1, gid); err != nil {
+			log.Fatalf(red("Error:")+" opening dnstap socket: %v", err)
+		}
+	} else {
+		log.Print(yellow("Only root can write to dnstap socket, use --dnstap-group for resolver running as own user"))
+	}
+	go func() {
+		for {
+			conn, err := dnstapListener.Accept()
+			if err != nil {
+				return
+			}
+			go handleDnstap(conn)
+		}
+	}()
+	log.Printf(green("Waiting for dnstap on `%s`"), args.Dnstap)
+}
+
+// lookupGroup accepts group name or GID
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	group, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+func stopDnstap() {
+	if dnstapListener != nil {
+		dnstapListener.Close()
+	}
+}
+
+// handleDnstap reads one Frame Streams session. Bidirectional writer starts
+// with READY and waits for ACCEPT, unidirectional one starts with START.
+func handleDnstap(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		frame, control, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF {
+				slog.Warn("dnstap connection closed", "err", err)
+			}
+			return
+		}
+		switch control {
+		case 0:
+			processDnstap(frame)
+		case fstrmControlReady:
+			if !fstrmHasContentType(frame) {
+				slog.Warn("dnstap writer doesn't offer " + dnstapContentType)
+				return
+			}
+			if err := writeControl(conn, fstrmControlAccept); err != nil {
+				slog.Warn("dnstap connection closed", "err", err)
+				return
+			}
+		case fstrmControlStart:
+			slog.Debug("dnstap stream started")
+		case fstrmControlStop:
+			writeControl(conn, fstrmControlFinish)
+			slog.Debug("dnstap stream stopped")
+			return
+		}
+	}
+}
+
+// readFrame returns data frame, or control type and fields of control frame
+func readFrame(r io.Reader) ([]byte, uint32, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, 0, err
+	}
+	control := length == 0
+	if control {
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, 0, err
+		}
+		if length < 4 {
+			return nil, 0, fmt.Errorf("control frame too short: %d", length)
+		}
+	}
+	if length > fstrmMaxFrame {
+		return nil, 0, fmt.Errorf("frame too long: %d", length)
+	}
+	frame := make([]byte, length)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, 0, err
+	}
+	if !control {
+		return frame, 0, nil
+	}
+	return frame[4:], binary.BigEndian.Uint32(frame), nil
+}
+
+func writeControl(w io.Writer, control uint32) error {
+	frame := binary.BigEndian.AppendUint32(nil, control)
+	if control == fstrmControlAccept {
+		frame = binary.BigEndian.AppendUint32(frame, fstrmFieldContentType)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(dnstapContentType)))
+		frame = append(frame, dnstapContentType...)
+	}
+	header := binary.BigEndian.AppendUint32(nil, 0)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(frame)))
+	_, err := w.Write(append(header, frame...))
+	return err
+}
+
+// Writer may offer several content types, or none meaning any
+func fstrmHasContentType(fields []byte) bool {
+	offered := false
+	for len(fields) >= 8 {
+		field := binary.BigEndian.Uint32(fields)
+		length := binary.BigEndian.Uint32(fields[4:])
+		fields = fields[8:]
+		if uint32(len(fields)) < length {
+			return false
+		}
+		if field == fstrmFieldContentType {
+			offered = true
+			if string(fields[:length]) == dnstapContentType {
+				return true
+			}
+		}
+		fields = fields[length:]
+	}
+	return !offered
+}
+
+func processDnstap(frame []byte) {
+	client, response, err := decodeDnstap(frame)
+	if err != nil {
+		slog.Debug("Bad dnstap frame", "err", err)
+		return
+	}
+	if response != nil {
+		processAnswer(client, response)
+	}
+}
+
+// decodeDnstap returns DNS answer with client address, nil for queries and
+// answers of no interest
+func decodeDnstap(frame []byte) (net.IP, []byte, error) {
+	var message []byte
+	var frameType uint64
+	err := walkProto(frame, func(f protoField) bool {
+		switch f.num {
+		case dnstapFieldMessage:
+			message = f.bytes
+		case dnstapFieldType:
+			frameType = f.value
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if frameType != dnstapTypeMessage || message == nil {
+		return nil, nil, nil
+	}
+
+	var messageType uint64
+	var client net.IP
+	var response []byte
+	err = walkProto(message, func(f protoField) bool {
+		switch f.num {
+		case dnstapMessageType:
+			messageType = f.value
+		case dnstapMessageQueryAddress:
+			client = net.IP(f.bytes)
+		case dnstapMessageResponseMessage:
+			response = f.bytes
+		}
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	switch messageType {
+	case dnstapClientResponse:
+		return client, response, nil
+	case dnstapForwarderResponse, dnstapResolverResponse, dnstapStubResponse:
+		// Resolver logging client responses too would give every answer twice.
+		// Query address is the resolver itself, client is unknown.
+		if args.DnstapUpstream {
+			return nil, response, nil
+		}
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func dnstapFrame(messageType uint64, client net.IP, response []byte) []byte {
+	var message []byte
+	message = protowire.AppendTag(message, dnstapMessageType, protowire.VarintType)
+	message = protowire.AppendVarint(message, messageType)
+	message = protowire.AppendTag(message, dnstapMessageQueryAddress, protowire.BytesType)
+	message = protowire.AppendBytes(message, client.To4())
+	message = protowire.AppendTag(message, dnstapMessageResponseMessage, protowire.BytesType)
+	message = protowire.AppendBytes(message, response)
+
+	var frame []byte
+	frame = protowire.AppendTag(frame, dnstapFieldMessage, protowire.BytesType)
+	frame = protowire.AppendBytes(frame, message)
+	frame = protowire.AppendTag(frame, dnstapFieldType, protowire.VarintType)
+	frame = protowire.AppendVarint(frame, dnstapTypeMessage)
+	return frame
+}
+
+func TestDecodeDnstapMessageTypes(t *testing.T) {
+	saved := args
+	t.Cleanup(func() { args = saved })
+	client := net.ParseIP("192.168.1.5")
+	response := []byte("answer")
+
+	tests := []struct {
+		name        string
+		messageType uint64
+		upstream    bool
+		wantAnswer  bool
+		wantClient  net.IP
+	}{
+		{"client response", dnstapClientResponse, false, true, client},
+		{"resolver response", dnstapResolverResponse, false, false, nil},
+		{"forwarder response", dnstapForwarderResponse, false, false, nil},
+		{"stub response", dnstapStubResponse, false, false, nil},
+		{"client response with --dnstap-upstream", dnstapClientResponse, true, true, client},
+		{"resolver response with --dnstap-upstream", dnstapResolverResponse, true, true, nil},
+		{"client query", 5, true, false, nil},
+	}
+	for _, tt := range tests {
+		args.DnstapUpstream = tt.upstream
+		gotClient, gotResponse, err := decodeDnstap(dnstapFrame(tt.messageType, client, response))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (gotResponse != nil) != tt.wantAnswer {
+			t.Errorf("%s: answer = %q, want answer %v", tt.name, gotResponse, tt.wantAnswer)
+		}
+		if !gotClient.Equal(tt.wantClient) {
+			t.Errorf("%s: client = %v, want %v", tt.name, gotClient, tt.wantClient)
+		}
+	}
+}
@@ -2,17 +2,28 @@ package main
 
 import (
 	"bufio"
-	"fmt"
 	"log"
+	"log/slog"
 	"os"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
 )
 
 var (
-	proxiedDomains  = make(map[string]struct{})
+	proxiedDomains = make(map[string]struct{})
+	// Suffixes too short to be trimmed domain, e.g. `.ru` or `.co.uk`
+	proxiedSuffixes = make(map[string]struct{})
 	proxiedPatterns []string
+	proxiedRegexps  []*regexp.Regexp
 	blockedDomains  = make(map[string]struct{})
+	// Domains blocked with subdomains
+	blockedSuffixes = make(map[string]struct{})
 	blockedPatterns []string
+	blockedRegexps  []*regexp.Regexp
+	// Guards proxiedDomains, which can change at runtime by --detect learn
+	listsMu sync.RWMutex
 )
 
 func isPattern(s string) bool {
@@ -44,6 +55,65 @@ func checkPattern(pattern, str string) bool {
 	return strings.HasSuffix(str, parts[len(parts)-1])
 }
 
+func isBlocked(name string) bool {
+	return blockRule(name) != ""
+}
+
+func isProxied(name string) bool {
+	return proxyRule(name) != ""
+}
+
+// blockRule returns domain, .suffix, glob or /regex/ from block list which matches name
+func blockRule(name string) string {
+	if _, blocked := blockedDomains[name]; blocked {
+		return name
+	}
+	for suffix := name; suffix != ""; {
+		if _, blocked := blockedSuffixes[suffix]; blocked {
+			return "." + suffix
+		}
+		_, suffix, _ = strings.Cut(suffix, ".")
+	}
+	if pattern := checkPatterns(name, blockedPatterns); pattern != "" {
+		return pattern
+	}
+	return checkRegexps(name, blockedRegexps)
+}
+
+// proxyRule returns trimmed domain, .suffix, glob or /regex/ from proxy list which matches name
+func proxyRule(name string) string {
+	key := trimDomain(name)
+	listsMu.RLock()
+	_, proxied := proxiedDomains[key]
+	listsMu.RUnlock()
+	if proxied {
+		return key
+	}
+	for suffix := name; suffix != ""; {
+		if _, proxied := proxiedSuffixes[suffix]; proxied {
+			return "." + suffix
+		}
+		_, suffix, _ = strings.Cut(suffix, ".")
+	}
+	if pattern := checkPatterns(name, proxiedPatterns); pattern != "" {
+		return pattern
+	}
+	return checkRegexps(name, proxiedRegexps)
+}
+
+// learnProxiedDomain adds trimmed domain to proxy list at runtime
+func learnProxiedDomain(key string) {
+	listsMu.Lock()
+	defer listsMu.Unlock()
+	proxiedDomains[key] = struct{}{}
+}
+
+func forgetProxiedDomain(key string) {
+	listsMu.Lock()
+	defer listsMu.Unlock()
+	delete(proxiedDomains, key)
+}
+
 func checkPatterns(str string, list []string) string {
 	for _, pattern := range list {
 		ok := checkPattern(pattern, str)
@@ -54,6 +124,15 @@ func checkPatterns(str string, list []string) string {
 	return ""
 }
 
+func checkRegexps(str string, list []*regexp.Regexp) string {
+	for _, re := range list {
+		if re.MatchString(str) {
+			return "/" + re.String() + "/"
+		}
+	}
+	return ""
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 // a.b.site.com   -> site.com
@@ -81,12 +160,76 @@ func trimDomain(domain string) string {
 	return strings.Join(lastTwo, ".")
 }
 
+func loadLists() {
+	readDomains(args.ProxyList, addProxiedDomain)
+	log.Printf("Proxies %d top-level domains, %d suffixes, %d globs, %d regexps\n",
+		len(proxiedDomains), len(proxiedSuffixes), len(proxiedPatterns), len(proxiedRegexps))
+	runtime.GC()
+
+	// Default block list is optional
+	if args.BlockList != "" && (args.BlockList != "blocks.lst" || fileExists(args.BlockList)) {
+		readDomains(args.BlockList, addBlockedDomain)
+		log.Printf("Block %d domains, %d with subdomains, %d globs, %d regexps\n",
+			len(blockedDomains), len(blockedSuffixes), len(blockedPatterns), len(blockedRegexps))
+		runtime.GC()
+	}
+}
+
+// Domain from a list file, with its location
+type listEntry struct {
+	domain string
+	source string
+	line   int
+}
+
 func readDomains(sources string, fn func(domain string)) {
+	unparsed := scanDomains(sources, func(entry listEntry) bool {
+		fn(entry.domain)
+		return true
+	})
+	for source, count := range unparsed {
+		log.Printf(yellow("Warning! %s: %d lines can't be parsed")+", run with -v to see them", source, count)
+	}
+}
+
+// findListEntry returns the first entry for which match is true
+func findListEntry(sources string, match func(domain string) bool) *listEntry {
+	var found *listEntry
+	scanDomains(sources, func(entry listEntry) bool {
+		if match(entry.domain) {
+			found = &entry
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// scanDomains calls fn for every rule of every list, until fn returns false.
+// Returns number of unparseable lines by file.
+func scanDomains(sources string, fn func(entry listEntry) bool) map[string]int {
+	unparsed := make(map[string]int)
 	for _, source := range strings.Split(sources, ";") {
 		source = strings.TrimSpace(source)
 		if source == "" {
 			continue
 		}
+		if file, code, ok := geoReference(source); ok {
+			rules, skipped, err := loadGeoSite(file, code)
+			if err != nil {
+				log.Fatalf(red("Error")+" reading %s: %v", source, err)
+			}
+			if skipped > 0 {
+				unparsed[source] = skipped
+			}
+			// Line is the rule number inside the category
+			for i, rule := range rules {
+				if !fn(listEntry{domain: rule, source: source, line: i + 1}) {
+					return unparsed
+				}
+			}
+			continue
+		}
 		file, err := os.Open(source)
 		if err != nil {
 			log.Fatalf(red("Error")+" opening file %s: %v", source, err)
@@ -95,45 +238,51 @@ func readDomains(sources string, fn func(domain string)) {
 		defer file.Close()
 
 		scanner := bufio.NewScanner(file)
+		line := 0
 		for scanner.Scan() {
-			domain := scanner.Text()
-			// Remove comment
-			if idx := strings.Index(domain, "#"); idx != -1 {
-				domain = domain[:idx]
-			}
-			domain = strings.TrimSpace(domain)
-			domain, _ = strings.CutPrefix(domain, "https-")
-			domain, _ = strings.CutPrefix(domain, "https.")
-			domain, _ = strings.CutPrefix(domain, "http-")
-			domain, _ = strings.CutPrefix(domain, "http.")
-			domain, _ = strings.CutPrefix(domain, "0.0.0.0 ")
-			domain, _ = strings.CutPrefix(domain, "127.0.0.1 ")
-			domain = strings.TrimSpace(domain)
-			domain = strings.ToLower(domain)
-			if domain == "" {
+			line++
+			rules, ok := parseListLine(scanner.Text())
+			if !ok {
+				unparsed[source]++
+				slog.Debug("Can't parse list line", "file", source, "line", line, "text", scanner.Text())
 				continue
 			}
-			fn(domain)
+			for _, rule := range rules {
+				if !fn(listEntry{domain: rule, source: source, line: line}) {
+					return unparsed
+				}
+			}
 		}
 
 		if err := scanner.Err(); err != nil {
 			log.Fatalf(red("Error")+" reading file %s: %v", source, err)
 		}
 	}
+	return unparsed
 }
 
 func addProxiedDomain(domain string) {
+	if isRegexRule(domain) {
+		proxiedRegexps = append(proxiedRegexps, regexp.MustCompile(domain[1:len(domain)-1]))
+		return
+	}
+	// Subdomains are proxied anyway
+	domain = strings.TrimPrefix(domain, ".")
 	pattern := checkPatterns(domain, proxiedPatterns)
 	if pattern != "" {
-		if args.Verbose {
-			fmt.Printf("PROXY: %s  ==  %s\n", pattern, domain)
-		}
+		slog.Debug("Duplicate of glob", "list", "proxy", "rule", pattern, "domain", domain)
 		return
 	}
 	if isPattern(domain) {
 		proxiedPatterns = append(proxiedPatterns, domain)
 		return
 	}
+	// Names under public suffix are trimmed to longer keys and would never
+	// match it, e.g. `ru` or `.ru` from geosite `domain:ru`
+	if trimDomain(domain) == domain && trimDomain("x."+domain) != domain {
+		proxiedSuffixes[domain] = struct{}{}
+		return
+	}
 	domain = trimDomain(domain)
 	if _, exists := proxiedDomains[domain]; !exists {
 		proxiedDomains[domain] = struct{}{}
@@ -141,16 +290,21 @@ func addProxiedDomain(domain string) {
 }
 
 func addBlockedDomain(domain string) {
-	pattern := checkPatterns(domain, blockedPatterns)
+	if isRegexRule(domain) {
+		blockedRegexps = append(blockedRegexps, regexp.MustCompile(domain[1:len(domain)-1]))
+		return
+	}
+	pattern := checkPatterns(strings.TrimPrefix(domain, "."), blockedPatterns)
 	if pattern != "" {
-		if args.Verbose {
-			fmt.Printf("BLOCK: %s  ==  %s\n", pattern, domain)
-		}
+		slog.Debug("Duplicate of glob", "list", "block", "rule", pattern, "domain", domain)
 		return
 	}
 	if isPattern(domain) {
 		blockedPatterns = append(blockedPatterns, domain)
-		println(domain)
+		return
+	}
+	if isSuffixRule(domain) {
+		blockedSuffixes[domain[1:]] = struct{}{}
 		return
 	}
 	if _, exists := blockedDomains[domain]; !exists {
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// writeGeoSite creates geosite.dat with one category of `domain:` entries
+func writeGeoSite(t *testing.T, code string, domains ...string) string {
+	t.Helper()
+	var site []byte
+	site = protowire.AppendTag(site, 1, protowire.BytesType)
+	site = protowire.AppendString(site, code)
+	for _, value := range domains {
+		var domain []byte
+		domain = protowire.AppendTag(domain, 1, protowire.VarintType)
+		domain = protowire.AppendVarint(domain, geoDomainDomain)
+		domain = protowire.AppendTag(domain, 2, protowire.BytesType)
+		domain = protowire.AppendString(domain, value)
+		site = protowire.AppendTag(site, 2, protowire.BytesType)
+		site = protowire.AppendBytes(site, domain)
+	}
+	var list []byte
+	list = protowire.AppendTag(list, 1, protowire.BytesType)
+	list = protowire.AppendBytes(list, site)
+
+	file := filepath.Join(t.TempDir(), "geosite.dat")
+	if err := os.WriteFile(file, list, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestProxySuffixRules(t *testing.T) {
+	savedDomains, savedSuffixes := proxiedDomains, proxiedSuffixes
+	proxiedDomains = make(map[string]struct{})
+	proxiedSuffixes = make(map[string]struct{})
+	t.Cleanup(func() { proxiedDomains, proxiedSuffixes = savedDomains, savedSuffixes })
+
+	geosite := writeGeoSite(t, "RU", "ru", "example.com")
+	readDomains(geosite+":ru;"+writePresets(t, ".co.uk\nya.ru\nsub.example.org\n"), addProxiedDomain)
+
+	tests := []struct {
+		name string
+		rule string
+	}{
+		{"yandex.ru", ".ru"},
+		{"ru", ".ru"},
+		{"mail.ya.ru", ".ya.ru"},
+		{"bbc.co.uk", ".co.uk"},
+		{"www.example.com", "example.com"},
+		// Trimmed, the whole domain is proxied
+		{"www.example.org", "example.org"},
+		{"example.net", ""},
+	}
+	for _, tt := range tests {
+		if rule := proxyRule(tt.name); rule != tt.rule {
+			t.Errorf("proxyRule(%q) = %q, want %q", tt.name, rule, tt.rule)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/alexflint/go-arg"
+)
+
+type ExportArgs struct {
+	Format    string `arg:"--format,-f,required" help:"dnsmasq-nftset, dnsmasq-ipset, mikrotik, unbound or hosts"`
+	Output    string `arg:"--output,-o" help:"Write to file instead of stdout"`
+	Set       string `arg:"--set" default:"dnsr_proxy" help:"nftset/ipset/address-list for IPs of proxied domains"`
+	NftTable  string `arg:"--nft-table" default:"inet#fw4" help:"Family and table of nftset for dnsmasq-nftset"`
+	ForwardTo string `arg:"--forward-to" default:"1.1.1.1" help:"DNS server for proxied domains in mikrotik format"`
+}
+
+// Export rule. Proxied domains always include subdomains, blocked ones only
+// when they come from `*.domain` globs.
+type exportRule struct {
+	domain     string
+	subdomains bool
+}
+
+// exportCommand converts lists into configuration of systems which can't run dnsr
+func exportCommand(argv []string) {
+	var exportArgs ExportArgs
+	parser, err := arg.NewParser(arg.Config{Program: "dnsr export"}, &exportArgs, &args.ListArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parser.MustParse(argv)
+
+	var write func(w *bufio.Writer, proxy, block []exportRule)
+	switch exportArgs.Format {
+	case "dnsmasq-nftset":
+		write = func(w *bufio.Writer, proxy, block []exportRule) {
+			for _, rule := range proxy {
+				fmt.Fprintf(w, "nftset=/%s/4#%s#%s\n", rule.domain, exportArgs.NftTable, exportArgs.Set)
+			}
+			writeDnsmasqBlock(w, block)
+		}
+	case "dnsmasq-ipset":
+		write = func(w *bufio.Writer, proxy, block []exportRule) {
+			for _, rule := range proxy {
+				fmt.Fprintf(w, "ipset=/%s/%s\n", rule.domain, exportArgs.Set)
+			}
+			writeDnsmasqBlock(w, block)
+		}
+	case "mikrotik":
+		write = func(w *bufio.Writer, proxy, block []exportRule) {
+			fmt.Fprintln(w, "/ip dns static")
+			for _, rule := range proxy {
+				fmt.Fprintf(w, "add name=%s type=FWD forward-to=%s address-list=%s match-subdomain=yes\n",
+					rule.domain, exportArgs.ForwardTo, exportArgs.Set)
+			}
+			for _, rule := range block {
+				fmt.Fprintf(w, "add name=%s type=NXDOMAIN match-subdomain=%s\n", rule.domain, yesNo(rule.subdomains))
+			}
+		}
+	case "unbound":
+		write = func(w *bufio.Writer, proxy, block []exportRule) {
+			fmt.Fprintln(w, "server:")
+			for _, rule := range proxy {
+				fmt.Fprintf(w, "    local-zone: \"%s.\" ipset\n", rule.domain)
+			}
+			for _, rule := range block {
+				if rule.subdomains {
+					fmt.Fprintf(w, "    local-zone: \"%s.\" always_nxdomain\n", rule.domain)
+				} else {
+					// Gets transparent zone, so subdomains are resolved as usual
+					fmt.Fprintf(w, "    local-data: \"%s. A 0.0.0.0\"\n", rule.domain)
+				}
+			}
+			if len(proxy) > 0 {
+				fmt.Fprintln(w, "ipset:")
+				fmt.Fprintf(w, "    name-v4: \"%s\"\n", exportArgs.Set)
+			}
+		}
+	case "hosts":
+		write = func(w *bufio.Writer, proxy, block []exportRule) {
+			if len(proxy) > 0 {
+				log.Printf(yellow("Warning! hosts format can't route domains, %d proxied domains skipped"), len(proxy))
+			}
+			skipped := 0
+			for _, rule := range block {
+				if rule.subdomains {
+					skipped++
+					continue
+				}
+				fmt.Fprintf(w, "0.0.0.0 %s\n", rule.domain)
+			}
+			if skipped > 0 {
+				log.Printf(yellow("Warning! hosts format can't match subdomains, %d globs skipped"), skipped)
+			}
+		}
+	default:
+		parser.Fail("unknown format: " + exportArgs.Format)
+	}
+
+	loadLists()
+	var proxy, block []exportRule
+	for domain := range proxiedDomains {
+		proxy = append(proxy, exportRule{domain: domain, subdomains: true})
+	}
+	for domain := range proxiedSuffixes {
+		proxy = append(proxy, exportRule{domain: domain, subdomains: true})
+	}
+	for domain := range blockedDomains {
+		block = append(block, exportRule{domain: domain})
+	}
+	for domain := range blockedSuffixes {
+		block = append(block, exportRule{domain: domain, subdomains: true})
+	}
+	if count := len(proxiedRegexps) + len(blockedRegexps); count > 0 {
+		log.Printf(yellow("Warning! %d regexps can't be exported"), count)
+	}
+	proxy = append(proxy, exportGlobs("proxy", proxiedPatterns)...)
+	block = append(block, exportGlobs("block", blockedPatterns)...)
+	sortExportRules(proxy)
+	sortExportRules(block)
+
+	out := os.Stdout
+	if exportArgs.Output != "" {
+		out, err = os.Create(exportArgs.Output)
+		if err != nil {
+			log.Fatalf(red("Error:")+" %v", err)
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+	write(w, proxy, block)
+	if err := w.Flush(); err != nil {
+		log.Fatalf(red("Error:")+" writing export: %v", err)
+	}
+}
+
+// Only `*.domain` globs have an equivalent in other systems
+func exportGlobs(list string, patterns []string) []exportRule {
+	var rules []exportRule
+	skipped := 0
+	for _, pattern := range patterns {
+		domain, found := strings.CutPrefix(pattern, "*.")
+		if !found || isPattern(domain) {
+			skipped++
+			continue
+		}
+		rules = append(rules, exportRule{domain: domain, subdomains: true})
+	}
+	if skipped > 0 {
+		log.Printf(yellow("Warning! %d globs of %s list can't be exported, only `*.domain` are supported"), skipped, list)
+	}
+	return rules
+}
+
+func writeDnsmasqBlock(w *bufio.Writer, block []exportRule) {
+	for _, rule := range block {
+		if rule.subdomains {
+			fmt.Fprintf(w, "address=/%s/\n", rule.domain)
+		} else {
+			// address= always matches subdomains too, host-record doesn't
+			fmt.Fprintf(w, "host-record=%s,0.0.0.0,::\n", rule.domain)
+		}
+	}
+}
+
+func sortExportRules(rules []exportRule) {
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].domain < rules[j].domain
+	})
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
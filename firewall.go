@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+)
+
+// Firewall installs and removes dnsr rules: NFQUEUE for DNS answers and
+// MASQUERADE for the tunnel interface
+type Firewall interface {
+	Name() string
+	// InstallQueue sends DNS answers (udp sport 53) to queues first..first+count-1,
+	// balanced by CPU
+	InstallQueue(first, count uint16) error
+	RemoveQueue(first, count uint16) error
+	// HasQueue reports whether queue rules are installed, e.g. left from previous run
+	HasQueue(first, count uint16) (bool, error)
+	Masquerade(iface string) error
+	RemoveMasquerade(iface string) error
+}
+
+var firewall Firewall
+
+// detectFirewall picks nftables or iptables, whichever is active on the system
+func detectFirewall() Firewall {
+	_, err := exec.LookPath("iptables")
+	iptablesAvailable := err == nil
+	nftTables, err := nftListTables()
+	nftablesAvailable := err == nil
+	//
+	iptablesActive := checkRules("iptables -L") || procNetExists("ip_tables_names")
+	nftablesActive := len(nftTables) > 0 || procNetExists("nf_tables")
+	//
+	if nftablesAvailable && nftablesActive {
+		if args.Verbose {
+			log.Println("Detected nftables")
+		}
+		return &nftFirewall{}
+	} else if iptablesAvailable && iptablesActive {
+		if args.Verbose {
+			log.Println("Detected iptables")
+		}
+		return &iptablesFirewall{}
+	} else if nftablesAvailable {
+		log.Println(yellow("Warning! Detected nftables, but may not be active"))
+		return &nftFirewall{}
+	} else if iptablesAvailable {
+		log.Println(yellow("Warning! Detected iptables, but may not be active"))
+		return &iptablesFirewall{}
+	}
+	log.Fatal(red("Neither iptables nor nftables were found."))
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// fakeFirewall keeps rules in memory and records every call, so rule setup and
+// teardown sequences can be checked without root
+type fakeFirewall struct {
+	mu    sync.Mutex
+	calls []string
+	// First queue -> count
+	queues map[uint16]uint16
+	masq   map[string]struct{}
+	// Returned by the next call, if set
+	err error
+}
+
+func newFakeFirewall() *fakeFirewall {
+	return &fakeFirewall{
+		queues: make(map[uint16]uint16),
+		masq:   make(map[string]struct{}),
+	}
+}
+
+func (f *fakeFirewall) record(format string, a ...any) error {
+	f.calls = append(f.calls, fmt.Sprintf(format, a...))
+	err := f.err
+	f.err = nil
+	return err
+}
+
+func (*fakeFirewall) Name() string {
+	return "fake"
+}
+
+func (f *fakeFirewall) InstallQueue(first, count uint16) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("install queue %d/%d", first, count); err != nil {
+		return err
+	}
+	if _, exists := f.queues[first]; exists {
+		return fmt.Errorf("queue %d already installed", first)
+	}
+	f.queues[first] = count
+	return nil
+}
+
+func (f *fakeFirewall) RemoveQueue(first, count uint16) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("remove queue %d/%d", first, count); err != nil {
+		return err
+	}
+	if installed, exists := f.queues[first]; !exists || installed != count {
+		return fmt.Errorf("queue %d/%d not installed", first, count)
+	}
+	delete(f.queues, first)
+	return nil
+}
+
+func (f *fakeFirewall) HasQueue(first, count uint16) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("has queue %d/%d", first, count); err != nil {
+		return false, err
+	}
+	_, exists := f.queues[first]
+	return exists, nil
+}
+
+func (f *fakeFirewall) Masquerade(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("masquerade %s", iface); err != nil {
+		return err
+	}
+	f.masq[iface] = struct{}{}
+	return nil
+}
+
+func (f *fakeFirewall) RemoveMasquerade(iface string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.record("remove masquerade %s", iface); err != nil {
+		return err
+	}
+	if _, exists := f.masq[iface]; !exists {
+		return fmt.Errorf("no masquerade for %s", iface)
+	}
+	delete(f.masq, iface)
+	return nil
+}
+
+// Calls returns recorded calls and resets the log
+func (f *fakeFirewall) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
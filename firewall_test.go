@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func withFakeFirewall(t *testing.T) *fakeFirewall {
+	t.Helper()
+	fake := newFakeFirewall()
+	saved, savedArgs := firewall, args
+	firewall = fake
+	args.Queues = 2
+	t.Cleanup(func() {
+		firewall, args = saved, savedArgs
+		queueRulesInstalled = false
+		queueFirst, queueCount = 0, 0
+		pendingPackets.Store(0)
+	})
+	return fake
+}
+
+func TestQueueRulesSetupTeardown(t *testing.T) {
+	fake := withFakeFirewall(t)
+
+	if err := installQueueRules(); err != nil {
+		t.Fatal(err)
+	}
+	if !queueRulesInstalled {
+		t.Error("queueRulesInstalled is false after install")
+	}
+	removeNfqueue()
+
+	want := []string{"install queue 2034/2", "has queue 2034/2", "remove queue 2034/2"}
+	if calls := fake.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	if len(fake.queues) != 0 {
+		t.Errorf("queues left after teardown: %v", fake.queues)
+	}
+}
+
+func TestRemoveNfqueueInstalledRange(t *testing.T) {
+	fake := withFakeFirewall(t)
+
+	if err := installQueueRules(); err != nil {
+		t.Fatal(err)
+	}
+	// Rules must be removed as installed, whatever args say on exit
+	args.Queues = 4
+	removeNfqueue()
+
+	want := []string{"install queue 2034/2", "has queue 2034/2", "remove queue 2034/2"}
+	if calls := fake.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+	if len(fake.queues) != 0 {
+		t.Errorf("queues left after teardown: %v", fake.queues)
+	}
+}
+
+func TestQueueRulesInstallError(t *testing.T) {
+	fake := withFakeFirewall(t)
+	fake.err = errors.New("no nf_tables")
+
+	if err := installQueueRules(); err == nil {
+		t.Fatal("expected error")
+	}
+	if queueRulesInstalled {
+		t.Error("queueRulesInstalled is true after failed install")
+	}
+}
+
+func TestRemoveNfqueueWithoutRules(t *testing.T) {
+	fake := withFakeFirewall(t)
+
+	removeNfqueue()
+	want := []string{"has queue 2034/2"}
+	if calls := fake.Calls(); !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls = %q, want %q", calls, want)
+	}
+}
+
+func TestWatchdogRemovesAndRestoresRules(t *testing.T) {
+	fake := withFakeFirewall(t)
+	args.Watchdog = time.Second
+	if err := installQueueRules(); err != nil {
+		t.Fatal(err)
+	}
+	fake.Calls()
+	// Ticks are made by the test
+	watchdogStop = make(chan struct{})
+	defer stopWatchdog()
+
+	// Packets are processed
+	pendingPackets.Store(1)
+	lastProgress.Store(time.Now().UnixNano())
+	checkProgress()
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("calls while processing = %q, want none", calls)
+	}
+
+	// Stalled
+	lastProgress.Store(time.Now().Add(-2 * time.Second).UnixNano())
+	checkProgress()
+	checkProgress()
+	if calls, want := fake.Calls(), []string{"remove queue 2034/2"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls when stalled = %q, want %q", calls, want)
+	}
+
+	// Resumed
+	pendingPackets.Store(0)
+	lastProgress.Store(time.Now().UnixNano())
+	checkProgress()
+	if calls, want := fake.Calls(), []string{"install queue 2034/2"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("calls when resumed = %q, want %q", calls, want)
+	}
+	if !queueRulesInstalled {
+		t.Error("queueRulesInstalled is false after resume")
+	}
+
+	// Watchdog doesn't restore rules removed on exit
+	removeNfqueue()
+	if queueRulesInstalled {
+		t.Error("queueRulesInstalled is true after removal")
+	}
+	fake.Calls()
+	checkProgress()
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("calls after removal = %q, want none", calls)
+	}
+}
+
+func TestIptablesQueueTarget(t *testing.T) {
+	tests := []struct {
+		first, count uint16
+		want         string
+	}{
+		{2034, 1, "--queue-num 2034 --queue-bypass"},
+		{2034, 4, "--queue-balance 2034:2037 --queue-bypass --queue-cpu-fanout"},
+	}
+	for _, tt := range tests {
+		if got := iptablesQueueTarget(tt.first, tt.count); got != tt.want {
+			t.Errorf("iptablesQueueTarget(%d, %d) = %q, want %q", tt.first, tt.count, got, tt.want)
+		}
+	}
+}
+
+func TestParseQueueRules(t *testing.T) {
+	output := `-P INPUT ACCEPT
+-P FORWARD ACCEPT
+-P OUTPUT ACCEPT
+-A INPUT -p udp -m udp --sport 53 -j NFQUEUE --queue-num 2034
+-A INPUT -p tcp -m tcp --dport 22 -j ACCEPT
+-A FORWARD -p udp -m udp --sport 53 -j NFQUEUE --queue-balance 2034:2037 --queue-bypass --queue-cpu-fanout
+-A FORWARD -p udp -m udp --sport 53 -j NFQUEUE --queue-num 20340 --queue-bypass
+-A OUTPUT -p udp -m udp --sport 53 -j NFQUEUE --queue-num 2034 --queue-bypass
+-A OUTPUT -p udp -m udp --sport 5353 -j NFQUEUE --queue-num 2034
+-A DOCKER -p udp -m udp --sport 53 -j NFQUEUE --queue-num 2034
+`
+	want := []string{
+		"-A INPUT -p udp -m udp --sport 53 -j NFQUEUE --queue-num 2034",
+		"-A FORWARD -p udp -m udp --sport 53 -j NFQUEUE --queue-balance 2034:2037 --queue-bypass --queue-cpu-fanout",
+		"-A OUTPUT -p udp -m udp --sport 53 -j NFQUEUE --queue-num 2034 --queue-bypass",
+	}
+	if got := parseQueueRules(output, 2034); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseQueueRules() = %q, want %q", got, want)
+	}
+}
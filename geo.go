@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// v2ray/xray geosite.dat and geoip.dat, referenced as `geosite.dat:google` in
+// domain lists and `geoip.dat:ru` in preset IPs. Category may be followed by
+// attribute, `geosite.dat:google@cn`, as in v2ray routing rules.
+//
+// See v2ray-core/app/router/routercommon/common.proto:
+//
+//	GeoSiteList { repeated GeoSite entry = 1; }
+//	GeoSite     { string country_code = 1; repeated Domain domain = 2; }
+//	Domain      { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+//	Attribute   { string key = 1; ... }
+//	GeoIPList   { repeated GeoIP entry = 1; }
+//	GeoIP       { string country_code = 1; repeated CIDR cidr = 2; }
+//	CIDR        { bytes ip = 1; uint32 prefix = 2; }
+
+// Domain.Type
+const (
+	geoDomainPlain  = 0 // substring
+	geoDomainRegex  = 1
+	geoDomainDomain = 2 // domain and subdomains
+	geoDomainFull   = 3
+)
+
+// geoReference splits `file.dat:code` list source
+func geoReference(source string) (file, code string, ok bool) {
+	idx := strings.LastIndex(source, ":")
+	if idx == -1 || !strings.HasSuffix(source[:idx], ".dat") {
+		return "", "", false
+	}
+	return source[:idx], strings.ToUpper(source[idx+1:]), true
+}
+
+// geoEntry returns entry with country_code of GeoSiteList/GeoIPList
+func geoEntry(file, code string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var found []byte
+	err = walkProto(data, func(f protoField) bool {
+		if f.num != 1 || f.bytes == nil {
+			return true
+		}
+		walkProto(f.bytes, func(field protoField) bool {
+			if field.num == 1 && strings.EqualFold(string(field.bytes), code) {
+				found = f.bytes
+			}
+			// Code comes first, don't walk the whole entry
+			return false
+		})
+		return found == nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s: no category %s", file, code)
+	}
+	return found, nil
+}
+
+// loadGeoSite returns list rules of the category, see parseListLine.
+// Unparseable domains are counted in skipped.
+func loadGeoSite(file, code string) (rules []string, skipped int, err error) {
+	code, attribute, _ := strings.Cut(code, "@")
+	entry, err := geoEntry(file, code)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = walkProto(entry, func(f protoField) bool {
+		if f.num != 2 || f.bytes == nil {
+			return true
+		}
+		var domainType uint64
+		var value string
+		hasAttribute := false
+		walkProto(f.bytes, func(field protoField) bool {
+			switch field.num {
+			case 1:
+				domainType = field.value
+			case 2:
+				value = string(field.bytes)
+			case 3:
+				walkProto(field.bytes, func(attr protoField) bool {
+					if attr.num == 1 && strings.EqualFold(string(attr.bytes), attribute) {
+						hasAttribute = true
+					}
+					return true
+				})
+			}
+			return true
+		})
+		if attribute != "" && !hasAttribute {
+			return true
+		}
+
+		var rule string
+		switch domainType {
+		case geoDomainPlain:
+			rule = "*" + strings.ToLower(value) + "*"
+		case geoDomainRegex:
+			rule = "/" + value + "/"
+		case geoDomainDomain:
+			rule = "." + value
+		case geoDomainFull:
+			rule = value
+		}
+		parsed, ok := parseListLine(rule)
+		if !ok || len(parsed) != 1 {
+			skipped++
+			return true
+		}
+		rules = append(rules, parsed[0])
+		return true
+	})
+	return rules, skipped, err
+}
+
+// loadGeoIP returns IPv4 networks of the country
+func loadGeoIP(file, code string) ([]*net.IPNet, error) {
+	entry, err := geoEntry(file, code)
+	if err != nil {
+		return nil, err
+	}
+	var nets []*net.IPNet
+	err = walkProto(entry, func(f protoField) bool {
+		if f.num != 2 || f.bytes == nil {
+			return true
+		}
+		var ip net.IP
+		var prefix uint64
+		walkProto(f.bytes, func(field protoField) bool {
+			switch field.num {
+			case 1:
+				ip = net.IP(field.bytes)
+			case 2:
+				prefix = field.value
+			}
+			return true
+		})
+		if ip4 := ip.To4(); len(ip) == net.IPv4len && prefix <= 32 {
+			nets = append(nets, &net.IPNet{IP: ip4, Mask: net.CIDRMask(int(prefix), 32)})
+		}
+		return true
+	})
+	return nets, err
+}
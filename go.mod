@@ -5,22 +5,24 @@ go 1.22.5
 require (
 	github.com/alexflint/go-arg v1.5.1
 	github.com/florianl/go-nfqueue v1.3.2
-	github.com/florianl/go-nfqueue/v2 v2.0.0
-	github.com/mdlayher/netlink v1.7.2
-	github.com/vishvananda/netlink v1.1.0
-	golang.org/x/net v0.30.0
-	golang.org/x/sys v0.26.0
+	github.com/google/nftables v0.3.0
+	github.com/mdlayher/netlink v1.7.3-0.20250113171957-fbb4dce95f42
+	github.com/oschwald/maxminddb-golang v1.13.1
+	github.com/vishvananda/netlink v1.3.0
+	github.com/vishvananda/netns v0.0.4
+	golang.org/x/net v0.33.0
+	golang.org/x/sys v0.28.0
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20230429144221-925a1e7659e6
+	google.golang.org/protobuf v1.36.6
 )
 
 require (
 	github.com/alexflint/go-scalar v1.2.0 // indirect
 	github.com/google/go-cmp v0.6.0 // indirect
-	github.com/josharian/native v1.1.0 // indirect
 	github.com/mdlayher/genetlink v1.3.2 // indirect
-	github.com/mdlayher/socket v0.4.1 // indirect
-	github.com/vishvananda/netns v0.0.0-20191106174202-0a2b9b5464df // indirect
-	golang.org/x/crypto v0.28.0 // indirect
-	golang.org/x/sync v0.7.0 // indirect
+	github.com/mdlayher/socket v0.5.0 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 	golang.zx2c4.com/wireguard v0.0.0-20230325221338-052af4a8072b // indirect
 )
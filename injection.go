@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Some ISPs inject forged DNS answers pointing to a block page. The forged
+// answer arrives before the genuine one, so dropping it is enough for client to
+// get the real answer. With --sniff and --dnstap client has it already, such
+// answers are only kept away from routes.
+
+var (
+	stubNets       []*net.IPNet
+	suspiciousTTLs = make(map[uint32]struct{})
+	injectedCount  atomic.Uint64
+	// Seen without NFQUEUE, can't be dropped
+	injectedIgnored atomic.Uint64
+)
+
+// passiveMode reports whether answers are only observed, not intercepted
+func passiveMode() bool {
+	return args.Sniff || args.Dnstap != ""
+}
+
+func loadInjectionRules() {
+	for _, ttl := range args.SuspiciousTTL {
+		suspiciousTTLs[ttl] = struct{}{}
+	}
+
+	for _, source := range strings.Split(args.StubIPs, ";") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		file, err := os.Open(source)
+		if err != nil {
+			log.Fatalf(red("Error")+" opening file %s: %v", source, err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			// Remove comment
+			if idx := strings.Index(line, "#"); idx != -1 {
+				line = line[:idx]
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			if !strings.Contains(line, "/") {
+				line += "/32"
+			}
+			_, ipNet, err := net.ParseCIDR(line)
+			if err != nil || ipNet.IP.To4() == nil {
+				log.Printf(yellow("Can't parse line in %s: ")+"%s", source, line)
+				continue
+			}
+			stubNets = append(stubNets, ipNet)
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf(red("Error")+" reading file %s: %v", source, err)
+		}
+	}
+
+	if len(stubNets) > 0 || len(suspiciousTTLs) > 0 {
+		log.Printf("Dropping injected answers: %d stub networks, %d suspicious TTLs", len(stubNets), len(suspiciousTTLs))
+	}
+}
+
+// injectionReason tells why the answer looks forged, empty if it doesn't
+func injectionReason(response *DNSResponse) string {
+	for _, ipList := range response.ips {
+		for _, ip := range ipList {
+			for _, stub := range stubNets {
+				if stub.Contains(ip) {
+					return fmt.Sprintf("stub ip %s", ip)
+				}
+			}
+		}
+	}
+	if _, suspicious := suspiciousTTLs[response.minTTL]; suspicious && len(response.ips) > 0 {
+		return fmt.Sprintf("ttl %d", response.minTTL)
+	}
+	return ""
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/florianl/go-nfqueue"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func dnsAnswer(t *testing.T, name string, ip string) []byte {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	builder.StartQuestions()
+	qname := dnsmessage.MustNewName(name + ".")
+	builder.Question(dnsmessage.Question{Name: qname, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	builder.StartAnswers()
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+	builder.AResource(dnsmessage.ResourceHeader{Name: qname, Class: dnsmessage.ClassINET, TTL: 300}, dnsmessage.AResource{A: a})
+	payload, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestInjectedAnswer(t *testing.T) {
+	tests := []struct {
+		name     string
+		sniff    bool
+		verdict  int
+		dropped  uint64
+		ignored  uint64
+		decision string
+	}{
+		{"nfqueue", false, nfqueue.NfDrop, 1, 0, "injected"},
+		{"sniff", true, nfqueue.NfAccept, 0, 1, "injected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := withFakeRouter(t)
+			savedDomains, savedStubs := proxiedDomains, stubNets
+			t.Cleanup(func() {
+				proxiedDomains, stubNets = savedDomains, savedStubs
+				injectedCount.Store(0)
+				injectedIgnored.Store(0)
+			})
+			proxiedDomains = map[string]struct{}{"blocked.com": {}}
+			_, stub, _ := net.ParseCIDR("10.10.10.0/24")
+			stubNets = []*net.IPNet{stub}
+			args.Sniff = tt.sniff
+
+			verdict, decision := processAnswer(net.ParseIP("192.168.1.5"), dnsAnswer(t, "blocked.com", "10.10.10.1"))
+			routeInstalls.Wait()
+
+			if verdict != tt.verdict || decision != tt.decision {
+				t.Errorf("verdict, decision = %d, %q, want %d, %q", verdict, decision, tt.verdict, tt.decision)
+			}
+			if injectedCount.Load() != tt.dropped || injectedIgnored.Load() != tt.ignored {
+				t.Errorf("dropped %d, ignored %d, want %d, %d",
+					injectedCount.Load(), injectedIgnored.Load(), tt.dropped, tt.ignored)
+			}
+			if routes, _ := fake.Routes(); len(routes) != 0 {
+				t.Errorf("routes = %v, injected answer must not be routed", routes)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type iptablesFirewall struct{}
+
+var queueChains = []string{"INPUT", "FORWARD", "OUTPUT"}
+
+func (*iptablesFirewall) Name() string {
+	return "iptables"
+}
+
+// `--queue-num N` or `--queue-balance N:M --queue-cpu-fanout`. With bypass
+// packets are accepted while nobody listens on the queue.
+func iptablesQueueTarget(first, count uint16) string {
+	if count <= 1 {
+		return fmt.Sprintf("--queue-num %d --queue-bypass", first)
+	}
+	return fmt.Sprintf("--queue-balance %d:%d --queue-bypass --queue-cpu-fanout", first, first+count-1)
+}
+
+func (*iptablesFirewall) InstallQueue(first, count uint16) error {
+	for _, chain := range queueChains {
+		err := runCommand(fmt.Sprintf("iptables -I %s -p udp --sport 53 -j NFQUEUE %s", chain, iptablesQueueTarget(first, count)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveQueue deletes rules exactly as `iptables -S` shows them, so rules
+// installed with other flags or queue count (older version, other --queues)
+// are removed too
+func (*iptablesFirewall) RemoveQueue(first, count uint16) error {
+	rules, err := iptablesQueueRules(first)
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return fmt.Errorf("no NFQUEUE rules for queue %d", first)
+	}
+	for _, rule := range rules {
+		err := runCommand("iptables -D" + strings.TrimPrefix(rule, "-A"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (*iptablesFirewall) HasQueue(first, count uint16) (bool, error) {
+	rules, err := iptablesQueueRules(first)
+	return len(rules) > 0, err
+}
+
+func iptablesQueueRules(first uint16) ([]string, error) {
+	output, err := commandOutput("iptables -S")
+	if err != nil {
+		return nil, err
+	}
+	return parseQueueRules(output, first), nil
+}
+
+// parseQueueRules picks `-A <chain> ... --sport 53 -j NFQUEUE` lines of
+// `iptables -S` output which send packets to queues starting with first
+func parseQueueRules(output string, first uint16) []string {
+	var rules []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" || !slices.Contains(queueChains, fields[1]) {
+			continue
+		}
+		var sport53, nfqueue, ours bool
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "--sport":
+				sport53 = fields[i+1] == "53"
+			case "-j":
+				nfqueue = fields[i+1] == "NFQUEUE"
+			case "--queue-num":
+				ours = fields[i+1] == strconv.Itoa(int(first))
+			case "--queue-balance":
+				ours = strings.HasPrefix(fields[i+1], strconv.Itoa(int(first))+":")
+			}
+		}
+		if sport53 && nfqueue && ours {
+			rules = append(rules, strings.Join(fields, " "))
+		}
+	}
+	return rules
+}
+
+func (*iptablesFirewall) Masquerade(iface string) error {
+	return runCommand(fmt.Sprintf("iptables -t nat -A POSTROUTING -o %s -j MASQUERADE", iface))
+}
+
+func (*iptablesFirewall) RemoveMasquerade(iface string) error {
+	return runCommand(fmt.Sprintf("iptables -t nat -D POSTROUTING -o %s -j MASQUERADE", iface))
+}
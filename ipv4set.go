@@ -3,18 +3,36 @@ package main
 import (
 	"net"
 	"sync"
+	"time"
 )
 
+// Not more domains are remembered per IP, shared CDN addresses can serve thousands
+const maxRouteDomains = 8
+
+// RouteInfo tells where a route came from
+type RouteInfo struct {
+	// "dns", "preset <file>" or "existing"
+	Origin  string
+	Domains []string
+	// CNAME chain of the last answer, starting from the last domain
+	CNAMEs    []string
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Hits      int
+}
+
 type IPv4Set struct {
 	mu       sync.RWMutex
-	set      map[string]struct{}
+	set      map[string]*RouteInfo
 	order    []string
 	capacity int
 }
 
+// NewIPv4Set creates set which evicts the oldest address when capacity is
+// reached, 0 for unlimited
 func NewIPv4Set(capacity int) *IPv4Set {
 	return &IPv4Set{
-		set:      make(map[string]struct{}),
+		set:      make(map[string]*RouteInfo),
 		order:    make([]string, 0, capacity),
 		capacity: capacity,
 	}
@@ -30,16 +48,44 @@ func (s *IPv4Set) Add(ip net.IP) bool {
 		return false
 	}
 
-	if len(s.order) >= s.capacity {
+	if s.capacity > 0 && len(s.order) >= s.capacity {
 		// Remove oldest
 		old := s.order[0]
 		s.order = s.order[1:]
 		delete(s.set, old)
 	}
+	s.insert(ipStr)
+	return true
+}
+
+// TryAdd inserts an IPv4 address if there is room, without evicting. Full is
+// true if the address is new and was skipped.
+func (s *IPv4Set) TryAdd(ip net.IP) (added, full bool) {
+	ipStr := ip.To4().String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.set[ipStr]; exists {
+		return false, false
+	}
+	if s.capacity > 0 && len(s.order) >= s.capacity {
+		return false, true
+	}
+	s.insert(ipStr)
+	return true, false
+}
 
-	s.set[ipStr] = struct{}{}
+func (s *IPv4Set) insert(ipStr string) {
+	now := time.Now()
+	s.set[ipStr] = &RouteInfo{FirstSeen: now, LastSeen: now}
 	s.order = append(s.order, ipStr)
-	return true
+}
+
+// Len returns number of addresses in the set
+func (s *IPv4Set) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.set)
 }
 
 // Exists checks if an IPv4 address is in the set.
@@ -50,3 +96,79 @@ func (s *IPv4Set) Exists(ip net.IP) bool {
 	_, exists := s.set[ipStr]
 	return exists
 }
+
+// Remove deletes an IPv4 address. Returns true if it was present.
+func (s *IPv4Set) Remove(ip net.IP) bool {
+	ipStr := ip.To4().String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.set[ipStr]; !exists {
+		return false
+	}
+	delete(s.set, ipStr)
+	for i, v := range s.order {
+		if v == ipStr {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// SetOrigin marks where the address came from, if it isn't marked yet
+func (s *IPv4Set) SetOrigin(ip net.IP, origin string) {
+	ipStr := ip.To4().String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, exists := s.set[ipStr]; exists && info.Origin == "" {
+		info.Origin = origin
+	}
+}
+
+// Record notes DNS answer for the address
+func (s *IPv4Set) Record(ip net.IP, domain string, cnames []string) {
+	ipStr := ip.To4().String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, exists := s.set[ipStr]
+	if !exists {
+		return
+	}
+	if info.Origin == "" {
+		info.Origin = "dns"
+	}
+	info.LastSeen = time.Now()
+	info.Hits++
+	info.CNAMEs = cnames
+	for _, d := range info.Domains {
+		if d == domain {
+			return
+		}
+	}
+	if len(info.Domains) < maxRouteDomains {
+		info.Domains = append(info.Domains, domain)
+	}
+}
+
+// Info returns a copy of the address provenance
+func (s *IPv4Set) Info(ip net.IP) (RouteInfo, bool) {
+	ipStr := ip.To4().String()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	info, exists := s.set[ipStr]
+	if !exists {
+		return RouteInfo{}, false
+	}
+	return *info, true
+}
+
+// Each calls fn for every address, oldest first
+func (s *IPv4Set) Each(fn func(ip string, info RouteInfo)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ipStr := range s.order {
+		fn(ipStr, *s.set[ipStr])
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Lines of domain lists are detected one by one, so files in different formats
+// can be mixed. Every line turns into zero or more rules:
+//
+//	example.com   exact domain (for proxy list also its subdomains)
+//	.example.com  domain and all subdomains
+//	*.example.*   glob
+//	/^ad[0-9]+\./ regular expression
+//
+// Supported formats:
+//
+//	example.com                     plain domain
+//	.example.com                    domain with subdomains
+//	https://example.com:443/path    URL
+//	0.0.0.0 example.com www.ex.com  hosts
+//	||example.com^                  AdBlock
+//	server=/example.com/ex.org/     dnsmasq server, address, local, ipset, nftset
+//	/regex/                         regular expression
+
+// Names of hosts files which are not rules
+var hostsIgnored = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"0.0.0.0":               {},
+}
+
+var dnsmasqOptions = []string{"server=", "address=", "local=", "ipset=", "nftset="}
+
+func isRegexRule(s string) bool {
+	return len(s) > 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/")
+}
+
+func isSuffixRule(s string) bool {
+	return strings.HasPrefix(s, ".")
+}
+
+// parseListLine returns rules of the line, ok is false for unparseable line
+func parseListLine(line string) (rules []string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+		// Empty, AdBlock comment or header
+		return nil, true
+	}
+	if isRegexRule(line) {
+		if _, err := regexp.Compile(line[1 : len(line)-1]); err != nil {
+			return nil, false
+		}
+		return []string{line}, true
+	}
+	// AdBlock cosmetic filters, `#` is not a comment there
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") {
+		return nil, false
+	}
+	if idx := strings.Index(line, "#"); idx != -1 {
+		line = strings.TrimSpace(line[:idx])
+		if line == "" {
+			return nil, true
+		}
+	}
+	line = strings.ToLower(line)
+
+	switch {
+	case strings.HasPrefix(line, "||"):
+		return parseAdblock(line)
+	case strings.HasPrefix(line, "@@"):
+		// Exceptions can't be expressed
+		return nil, false
+	case hasDnsmasqOption(line):
+		return parseDnsmasq(line)
+	case strings.Contains(line, "://"):
+		return parseURL(line)
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) > 1 {
+		if net.ParseIP(fields[0]) == nil {
+			return nil, false
+		}
+		return parseHosts(fields[1:])
+	}
+	return parseDomain(line)
+}
+
+// ||example.com^ or ||example.com^$important
+func parseAdblock(line string) ([]string, bool) {
+	line = line[2:]
+	domain, options, _ := strings.Cut(line, "$")
+	if options != "" && options != "important" {
+		return nil, false
+	}
+	domain, found := strings.CutSuffix(domain, "^")
+	if !found {
+		// Path or other anchors
+		return nil, false
+	}
+	rule, ok := normalizeDomain(domain)
+	if !ok {
+		return nil, false
+	}
+	return []string{"." + rule}, true
+}
+
+func hasDnsmasqOption(line string) bool {
+	for _, option := range dnsmasqOptions {
+		if strings.HasPrefix(line, option) {
+			return true
+		}
+	}
+	return false
+}
+
+// server=/a.com/b.com/1.1.1.1, address=/a.com/
+func parseDnsmasq(line string) ([]string, bool) {
+	_, value, _ := strings.Cut(line, "=")
+	parts := strings.Split(value, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, false
+	}
+	var rules []string
+	for _, domain := range parts[1 : len(parts)-1] {
+		if domain == "" || domain == "#" {
+			continue
+		}
+		rule, ok := normalizeDomain(domain)
+		if !ok {
+			return nil, false
+		}
+		rules = append(rules, "."+rule)
+	}
+	return rules, true
+}
+
+func parseURL(line string) ([]string, bool) {
+	u, err := url.Parse(line)
+	if err != nil || u.Hostname() == "" {
+		return nil, false
+	}
+	return parseDomain(u.Hostname())
+}
+
+func parseHosts(names []string) ([]string, bool) {
+	var rules []string
+	for _, name := range names {
+		if _, ignored := hostsIgnored[name]; ignored || strings.HasPrefix(name, "ip6-") {
+			continue
+		}
+		rule, ok := normalizeDomain(name)
+		if !ok {
+			return nil, false
+		}
+		rules = append(rules, rule)
+	}
+	return rules, true
+}
+
+// Domain, glob or .suffix, possibly with odd prefixes, path or port
+func parseDomain(domain string) ([]string, bool) {
+	domain, _ = strings.CutPrefix(domain, "https-")
+	domain, _ = strings.CutPrefix(domain, "https.")
+	domain, _ = strings.CutPrefix(domain, "http-")
+	domain, _ = strings.CutPrefix(domain, "http.")
+	domain, _, _ = strings.Cut(domain, "/")
+	if host, port, err := net.SplitHostPort(domain); err == nil && port != "" {
+		domain = host
+	}
+
+	suffix := isSuffixRule(domain)
+	rule, ok := normalizeDomain(strings.TrimPrefix(domain, "."))
+	if !ok {
+		return nil, false
+	}
+	if suffix {
+		rule = "." + rule
+	}
+	return []string{rule}, true
+}
+
+// normalizeDomain converts to lowercase ASCII and checks characters
+func normalizeDomain(domain string) (string, bool) {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if domain == "" {
+		return "", false
+	}
+	for _, c := range domain {
+		if c >= 0x80 {
+			ascii, err := idna.Lookup.ToASCII(domain)
+			if err != nil {
+				return "", false
+			}
+			domain = ascii
+			break
+		}
+	}
+	for _, c := range domain {
+		valid := c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '*'
+		if !valid {
+			return "", false
+		}
+	}
+	if strings.HasPrefix(domain, ".") || strings.Contains(domain, "..") {
+		return "", false
+	}
+	return domain, true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseListLine(t *testing.T) {
+	tests := []struct {
+		line  string
+		rules []string
+		ok    bool
+	}{
+		// Comments and empty lines
+		{"", nil, true},
+		{"# comment", nil, true},
+		{"! AdBlock comment", nil, true},
+		{"[Adblock Plus 2.0]", nil, true},
+
+		// Plain domains
+		{"Example.COM", []string{"example.com"}, true},
+		{".example.com", []string{".example.com"}, true},
+		{"example.com. # trailing comment", []string{"example.com"}, true},
+		{"*.example.*", []string{"*.example.*"}, true},
+		{"exa mple", nil, false},
+		{"bad!domain.com", nil, false},
+
+		// AdBlock
+		{"||ads.example.com^", []string{".ads.example.com"}, true},
+		{"||ads.example.com^$important", []string{".ads.example.com"}, true},
+		{"||ads.example.com^$third-party", nil, false},
+		{"||ads.example.com/banner", nil, false},
+		{"@@||good.example.com^", nil, false},
+		{"example.com##.banner", nil, false},
+
+		// dnsmasq
+		{"server=/example.com/1.1.1.1", []string{".example.com"}, true},
+		{"server=/a.com/b.org/10.0.0.1#5353", []string{".a.com", ".b.org"}, true},
+		{"address=/ads.example.com/", []string{".ads.example.com"}, true},
+		{"nftset=/example.com/4#inet#fw4#proxy", []string{".example.com"}, true},
+		{"server=1.1.1.1", nil, false},
+
+		// hosts
+		{"0.0.0.0 ads.example.com", []string{"ads.example.com"}, true},
+		{"127.0.0.1 a.example.com b.example.com c.example.com", []string{"a.example.com", "b.example.com", "c.example.com"}, true},
+		{"127.0.0.1 localhost", nil, true},
+		{"::1 localhost ip6-localhost ip6-loopback", nil, true},
+		{"not-an-ip a.example.com", nil, false},
+
+		// URLs
+		{"https://example.com/path?q=1", []string{"example.com"}, true},
+		{"http://Example.com:8080", []string{"example.com"}, true},
+		{"example.com:443/path", []string{"example.com"}, true},
+		{"https://", nil, false},
+
+		// Regular expressions
+		{`/^ad[0-9]+\./`, []string{`/^ad[0-9]+\./`}, true},
+		{"/ad[/", nil, false},
+
+		// IDN
+		{"пример.рф", []string{"xn--e1afmkfd.xn--p1ai"}, true},
+		{".Пример.РФ", []string{".xn--e1afmkfd.xn--p1ai"}, true},
+		{"||пример.рф^", []string{".xn--e1afmkfd.xn--p1ai"}, true},
+	}
+	for _, tt := range tests {
+		rules, ok := parseListLine(tt.line)
+		if ok != tt.ok || !reflect.DeepEqual(rules, tt.rules) {
+			t.Errorf("parseListLine(%q) = %q, %v; want %q, %v", tt.line, rules, ok, tt.rules, tt.ok)
+		}
+	}
+}
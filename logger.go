@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"log/syslog"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Events are logged with log/slog. Plain `log` calls go through the same handler
+// with INFO level, so every line respects the chosen format and destination.
+
+// Colors only make sense on terminal
+var colors = isTerminal(os.Stdout)
+
+func setupLogging() {
+	level := slog.LevelInfo
+	if args.Verbose {
+		level = slog.LevelDebug
+	}
+
+	var handler slog.Handler
+	if args.Syslog {
+		colors = false
+		writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "dnsr")
+		if err != nil {
+			log.Fatalf("Can't connect to syslog: %v", err)
+		}
+		handler = &syslogHandler{writer: writer, level: level, json: args.LogFormat == "json"}
+	} else if args.LogFormat == "json" {
+		colors = false
+		handler = slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	} else if args.LogFormat == "text" {
+		handler = &consoleHandler{mu: &sync.Mutex{}, w: os.Stdout, level: level, time: true}
+	} else {
+		log.Fatalf(red("Unknown log format: ")+"%s", args.LogFormat)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// textLogging is true when output is meant for human on stdout
+func textLogging() bool {
+	return !args.Syslog && args.LogFormat == "text"
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// consoleHandler prints `2006/01/02 15:04:05 message key=value ...` like `log` did
+type consoleHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	level slog.Leveler
+	attrs []slog.Attr
+	time  bool
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	if h.time {
+		buf.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+	}
+	switch {
+	case r.Level >= slog.LevelError:
+		buf.WriteString(red("ERROR "))
+	case r.Level >= slog.LevelWarn:
+		buf.WriteString(yellow("WARN "))
+	}
+	buf.WriteString(r.Message)
+	writeAttr := func(a slog.Attr) bool {
+		fmt.Fprintf(&buf, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		writeAttr(a)
+	}
+	r.Attrs(writeAttr)
+	if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &h2
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// syslogHandler sends records to syslog with matching priority. Syslog adds
+// timestamp by itself.
+type syslogHandler struct {
+	writer *syslog.Writer
+	level  slog.Leveler
+	attrs  []slog.Attr
+	json   bool
+}
+
+func (h *syslogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	var buf bytes.Buffer
+	var inner slog.Handler
+	if h.json {
+		inner = slog.NewJSONHandler(&buf, &slog.HandlerOptions{
+			Level: h.level,
+			// Syslog adds timestamp and priority by itself
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+					return slog.Attr{}
+				}
+				return a
+			},
+		})
+	} else {
+		inner = &consoleHandler{mu: &sync.Mutex{}, w: &buf, level: h.level}
+	}
+	if err := inner.WithAttrs(h.attrs).Handle(ctx, r); err != nil {
+		return err
+	}
+
+	msg := string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.writer.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.writer.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.writer.Info(msg)
+	default:
+		return h.writer.Debug(msg)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &h2
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return h
+}
@@ -3,15 +3,15 @@ package main
 import (
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"os/signal"
 	"runtime"
-	"strings"
 	"syscall"
+	"time"
 
 	"github.com/alexflint/go-arg"
-	"github.com/vishvananda/netlink"
 )
 
 const (
@@ -21,28 +21,104 @@ const (
 )
 
 type Args struct {
-	WGConfig   string `arg:"positional" help:"Path to WireGuard configuration file"`
-	Interface  string `arg:"-i,--interface" help:"Use existing WireGuard interface instead of creating new one from config"`
-	ProxyList  string `arg:"--proxy-list" default:"proxy.lst" help:"File with list of domains to proxy through WireGuard(or specified interface)"`
-	BlockList  string `arg:"--block-list" default:"blocks.lst" help:"File with list of domains to block completely"`
-	PresetIPs  string `arg:"--preset-ips" help:"File with IP addresses to proxy immediately, without waiting for DNS resolution"`
-	Force      bool   `arg:"-f,--force" help:"Force remove existing dnsr-wg interface and create new one"`
-	Silent     bool   `arg:"-s,--silent" help:"Don't show when new routes are added"`
-	Verbose    bool   `arg:"-v,--verbose" help:"Enable verbose output for all DNS-answers"`
-	Persistent bool   `arg:"-p,--persistent" help:"Keep WireGuard interface (if created) and routes after exit"`
+	WGConfig  string `arg:"positional" help:"Path to WireGuard configuration file"`
+	Interface string `arg:"-i,--interface" help:"Use existing WireGuard interface instead of creating new one from config"`
+	ListArgs
+	DecisionArgs
+	ControlArgs
+	QueryLogArgs
+	PresetIPs   string `arg:"--preset-ips" help:"File with IPs, networks, ranges or AS numbers to proxy immediately, without waiting for DNS resolution"`
+	BlockIPs    string `arg:"--block-ips" help:"File with IPs, networks, ranges or AS numbers to block with blackhole routes"`
+	ASNDatabase string `arg:"--asn-db" help:"ASN to prefix database for AS numbers in preset IPs (pfx2as, ip2asn-v4.tsv or CIDR ASN lines)"`
+	Force       bool   `arg:"-f,--force" help:"Force remove existing dnsr-wg interface and create new one"`
+	Silent      bool   `arg:"-s,--silent" help:"Don't show when new routes are added"`
+	Verbose     bool   `arg:"-v,--verbose" help:"Enable verbose output for all DNS-answers"`
+	Persistent  bool   `arg:"-p,--persistent" help:"Keep WireGuard interface (if created) and routes after exit"`
+	LogFormat   string `arg:"--log-format" default:"text" help:"Log format: text or json"`
+	Syslog      bool   `arg:"--syslog" help:"Write log to syslog (logd on OpenWrt) instead of stdout"`
+
+	QueryLogSize  int           `arg:"--query-log-size" default:"1024" help:"Rotate query log when it exceeds this size, KiB"`
+	QueryLogFiles int           `arg:"--query-log-files" default:"2" help:"Number of rotated query log files to keep, 0 to start the log over when it's full"`
+	QueryLogAge   time.Duration `arg:"--query-log-age" default:"168h" help:"Remove rotated query log files older than this, 0 to keep"`
+
+	Queues   int    `arg:"--queues" default:"1" help:"Number of NFQUEUE queues, answers are balanced between them by CPU"`
+	QueueLen uint32 `arg:"--queue-len" default:"1024" help:"Max packets waiting in each queue"`
+	Workers  int    `arg:"--workers" help:"Number of goroutines processing DNS answers"`
+
+	VerdictTimeout time.Duration `arg:"--verdict-timeout" default:"2s" help:"Accept DNS answer if it isn't processed in this time, 0 to wait forever"`
+	SyncRoutes     bool          `arg:"--sync-routes" help:"Hold DNS answer until routes for its IPs are installed"`
+	RouteTimeout   time.Duration `arg:"--route-timeout" default:"500ms" help:"Max time to hold DNS answer with --sync-routes"`
+	Watchdog       time.Duration `arg:"--watchdog" default:"10s" help:"Remove NFQUEUE rules if answers aren't processed for this time, 0 to disable"`
+
+	Sniff          bool   `arg:"--sniff" help:"Sniff DNS answers from a packet socket instead of NFQUEUE, without blocking"`
+	Dnstap         string `arg:"--dnstap" help:"Read DNS answers from resolver via dnstap unix socket instead of NFQUEUE, without blocking"`
+	DnstapGroup    string `arg:"--dnstap-group" help:"Group (name or GID) allowed to write to --dnstap socket, e.g. unbound"`
+	DnstapUpstream bool   `arg:"--dnstap-upstream" help:"Also use resolver, forwarder and stub responses from --dnstap, for resolvers which don't log client responses"`
+
+	Netns           string `arg:"--netns" help:"Network namespace (name or path) for interface, routes, firewall rules and NFQUEUE"`
+	NetnsKeepSocket bool   `arg:"--netns-keep-socket" help:"Create WireGuard interface in current namespace and move it to --netns, so its UDP socket stays here"`
+
+	Detect      string        `arg:"--detect" help:"Detect blocked sites by failed direct connections: suggest or learn"`
+	Suggestions string        `arg:"--suggestions" default:"suggestions.lst" help:"File for domains found by --detect suggest"`
+	LearnTTL    time.Duration `arg:"--learn-ttl" default:"24h" help:"How long domains found by --detect learn stay proxied, they are forgotten on restart"`
+
+	EndpointRefresh time.Duration `arg:"--endpoint-refresh" default:"1m" help:"How often to re-resolve hostname endpoints of WireGuard peers, 0 to disable"`
+}
+
+// Shared by daemon and commands that load domain lists
+type ListArgs struct {
+	ProxyList string `arg:"--proxy-list" default:"proxy.lst" help:"File with list of domains to proxy through WireGuard(or specified interface)"`
+	BlockList string `arg:"--block-list" default:"blocks.lst" help:"File with list of domains to block completely"`
+}
+
+// Options of DNS answer processing, shared by daemon and replay
+type DecisionArgs struct {
+	StubIPs          string   `arg:"--stub-ips" help:"File with block-page IPs/CIDRs, answers for proxied domains with them are dropped as injected"`
+	SuspiciousTTL    []uint32 `arg:"--suspicious-ttl" help:"DNS TTL values of injected answers, answers for proxied domains with them are dropped"`
+	GeoDB            string   `arg:"--geoip-db" help:"MaxMind-format database (.mmdb) for --geo-proxy and --geo-direct"`
+	GeoProxy         []string `arg:"--geo-proxy" help:"Proxy answer IPs located in these countries, e.g. US DE"`
+	GeoDirect        []string `arg:"--geo-direct" help:"Don't proxy answer IPs located in these countries, even for proxied domains. Preset IPs and existing routes are kept"`
+	BlackholeBlocked bool     `arg:"--blackhole-blocked" help:"Also blackhole IPs from answers for blocked domains"`
 }
 
 func (Args) Version() string {
 	return "dnsr 4.0.0"
 }
 
+func (Args) Epilogue() string {
+	return `Commands:
+  check DOMAIN...      Explain whether domains are blocked, proxied or direct
+  export --format F    Convert lists to dnsmasq, MikroTik, unbound or hosts configuration
+  log                  Show query log filtered by --domain, --client or --decision
+  replay CAPTURE       Show decisions for DNS answers from pcap/pcapng file
+  status               Show routes of running dnsr
+  why IP...            Show which DNS answers created routes of running dnsr`
+}
+
+// Commands don't require root and don't touch the system
+var commands = map[string]func(argv []string){
+	"check":  checkCommand,
+	"export": exportCommand,
+	"log":    logCommand,
+	"replay": replayCommand,
+	"status": statusCommand,
+	"why":    whyCommand,
+}
+
 var (
-	args   Args
-	useNFT bool
+	args Args
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+	args.Workers = runtime.NumCPU()
 	arg.MustParse(&args)
+	setupLogging()
 
 	// Validate
 	if args.WGConfig != "" && args.Interface != "" {
@@ -57,6 +133,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	if args.Sniff && args.Dnstap != "" {
+		log.Fatal(red("Mutually exclusive options: use either --sniff or --dnstap"))
+	}
+	if args.DnstapUpstream && args.Dnstap == "" {
+		log.Fatal(red("--dnstap-upstream requires --dnstap"))
+	}
+
 	if args.ProxyList == "proxy.lst" && !fileExists(args.ProxyList) {
 		fmt.Printf(red("Error:")+" The proxy list file '%s' does not exist.\n", args.ProxyList)
 		fmt.Println("To download a good proxy list, you can use the following command:")
@@ -82,39 +165,20 @@ func main() {
 		log.Fatal(red("Must be run as root"))
 	}
 
+	setupNetns()
+
 	// Detect iptables/nftables
-	_, err := exec.LookPath("iptables")
-	iptablesAvailable := err == nil
-	_, err = exec.LookPath("nft")
-	nftablesAvailable := err == nil
-	//
-	iptablesActive := checkRules("iptables -L") || fileExists("/proc/net/ip_tables_names")
-	nftablesActive := checkRules("nft list ruleset") || fileExists("/proc/net/nf_tables")
-	//
-	if nftablesAvailable && nftablesActive {
-		if args.Verbose {
-			log.Println("Detected nftables")
-		}
-		useNFT = true
-	} else if iptablesAvailable && iptablesActive {
-		if args.Verbose {
-			log.Println("Detected iptables")
-		}
-	} else if nftablesAvailable {
-		log.Println(yellow("Warning! Detected nftables, but may not be active"))
-		useNFT = true
-	} else if iptablesAvailable {
-		log.Println(yellow("Warning! Detected iptables, but may not be active"))
-	} else {
-		log.Fatal(red("Neither iptables nor nftables were found."))
-	}
+	firewall = detectFirewall()
 
 	if err := syscall.Setgid(GID); err != nil {
 		log.Fatalf(red("Can't change GID: %v\n"), err)
 	}
 
 	// Enable IP forwarding
-	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+	err := inNetns(func() error {
+		return os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644)
+	})
+	if err != nil {
 		log.Fatalf(red("Failed to enable IP forwarding: %v"), err)
 	}
 
@@ -123,26 +187,21 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	//
-	readDomains(args.ProxyList, addProxiedDomain)
-	log.Printf("Proxies %d top-level domains, %d globs\n", len(proxiedDomains), len(proxiedPatterns))
-	runtime.GC()
-
-	if fileExists(args.BlockList) {
-		readDomains(args.BlockList, addBlockedDomain)
-		log.Printf("Block %d domains, %d globs\n", len(blockedDomains), len(blockedPatterns))
-		runtime.GC()
-	}
+	loadLists()
+	loadInjectionRules()
+	loadGeoDB()
+	defer closeGeoDB()
 
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 	log.Printf("Total mem usage: %v MiB\n", m.TotalAlloc/1024/1024)
 
 	if args.Silent {
-		fmt.Println("Silent mode, run without -s for verbose output")
+		log.Println("Silent mode, run without -s for verbose output")
 	}
 
 	// Check for existing interface
-	link, err = netlink.LinkByName(INTERFACE_NAME)
+	link, err = nl.LinkByName(INTERFACE_NAME)
 	if err == nil && args.Interface != INTERFACE_NAME {
 		log.Print(yellow("An existing `dnsr-wg` interface was found."))
 		log.Print(yellow("This could be because:"))
@@ -166,7 +225,7 @@ func main() {
 		setupWireguard()
 		defer removeWireguard(false)
 	} else {
-		link, err = netlink.LinkByName(args.Interface)
+		link, err = nl.LinkByName(args.Interface)
 		if err != nil {
 			log.Fatalf(red("Error:")+" getting `%s` interface: %v", args.Interface, err)
 		}
@@ -174,22 +233,45 @@ func main() {
 		log.Printf(green("Using `%s` interface"), args.Interface)
 	}
 
+	router = newNetlinkRouter(link)
 	setupRouting()
 	defer cleanupRouting()
 
-	setupNfqueue()
-	defer removeNfqueue()
+	setupBlackholes()
+	defer cleanupBlackholes()
+
+	startQueryLog()
+	defer stopQueryLog()
+
+	// Answers are processed as soon as they arrive, so detector must exist before
+	startDetector()
+	defer stopDetector()
+
+	if args.Dnstap != "" {
+		startDnstap()
+		defer stopDnstap()
+	} else if args.Sniff {
+		startSniffer()
+		defer stopSniffer()
+	} else {
+		setupNfqueue()
+		startWatchdog()
+		defer removeNfqueue()
+	}
+
+	startControl()
+	defer stopControl()
 
-	fmt.Println("====================")
+	if textLogging() {
+		fmt.Println("====================")
+	}
 	<-sigChan
 	log.Println("Shutting down...")
 
 	if args.Interface != "" {
 		// Remove MASQUERADE rule
-		if useNFT {
-			execCommand("nft delete table ip dnsr-nat")
-		} else {
-			execCommand(fmt.Sprintf("iptables -t nat -D POSTROUTING -o %s -j MASQUERADE", args.Interface))
+		if err := firewall.RemoveMasquerade(args.Interface); err != nil {
+			log.Fatal(red("Error: "), err)
 		}
 	}
 }
@@ -197,15 +279,22 @@ func main() {
 ///////////////////////////////////////////////////////////////////////////////
 
 func red(str string) string {
-	return "\033[31m" + str + "\033[0m"
+	return color("\033[31m", str)
 }
 
 func green(str string) string {
-	return "\033[32m" + str + "\033[0m"
+	return color("\033[32m", str)
 }
 
 func yellow(str string) string {
-	return "\033[33m" + str + "\033[0m"
+	return color("\033[33m", str)
+}
+
+func color(code, str string) string {
+	if !colors {
+		return str
+	}
+	return code + str + "\033[0m"
 }
 
 func fileExists(path string) bool {
@@ -213,21 +302,32 @@ func fileExists(path string) bool {
 	return !os.IsNotExist(err)
 }
 
-func execCommand(cmdargs ...string) {
-	cmd := strings.Join(cmdargs, " ")
-	if args.Verbose {
-		fmt.Println(yellow("EXEC") + "  " + cmd)
-	}
-	output, err := exec.Command("sh", "-c", cmd).CombinedOutput()
+func runCommand(cmd string) error {
+	slog.Debug("EXEC", "cmd", cmd)
+	var output []byte
+	err := inNetns(func() (err error) {
+		output, err = exec.Command("sh", "-c", cmd).CombinedOutput()
+		return err
+	})
 	if err != nil {
 		if !args.Verbose {
-			fmt.Println(yellow("EXEC") + "  " + cmd)
+			slog.Info("EXEC", "cmd", cmd)
 		}
-		log.Fatalf(red("%v")+", output: %s \n", err, output)
+		return fmt.Errorf("%v, output: %s", err, output)
 	}
+	return nil
+}
+
+func commandOutput(cmd string) (string, error) {
+	var output []byte
+	err := inNetns(func() (err error) {
+		output, err = exec.Command("sh", "-c", cmd).Output()
+		return err
+	})
+	return string(output), err
 }
 
 func checkRules(cmd string) bool {
-	output, err := exec.Command("sh", "-c", cmd).Output()
+	output, err := commandOutput(cmd)
 	return err == nil && len(output) > 0
 }
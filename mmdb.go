@@ -0,0 +1,100 @@
+package main
+
+import (
+	"log"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Routing by country of answer IPs, from MaxMind-format database (GeoLite2,
+// DB-IP, ...). Catches geo-blocked services which are not in any list, and
+// keeps local services direct even when their domains are proxied.
+
+var (
+	geoDB *maxminddb.Reader
+	// ISO codes, upper case
+	geoProxyCountries  = make(map[string]struct{})
+	geoDirectCountries = make(map[string]struct{})
+)
+
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+func loadGeoDB() {
+	if args.GeoDB == "" {
+		if len(args.GeoProxy) > 0 || len(args.GeoDirect) > 0 {
+			log.Fatal(red("Error:") + " --geo-proxy and --geo-direct require --geoip-db")
+		}
+		return
+	}
+	var err error
+	geoDB, err = maxminddb.Open(args.GeoDB)
+	if err != nil {
+		log.Fatalf(red("Error")+" opening %s: %v", args.GeoDB, err)
+	}
+	for _, country := range args.GeoProxy {
+		geoProxyCountries[strings.ToUpper(country)] = struct{}{}
+	}
+	for _, country := range args.GeoDirect {
+		geoDirectCountries[strings.ToUpper(country)] = struct{}{}
+	}
+	log.Printf("GeoIP database %s: %s, proxy %d countries, direct %d countries",
+		args.GeoDB, geoDB.Metadata.DatabaseType, len(geoProxyCountries), len(geoDirectCountries))
+}
+
+func closeGeoDB() {
+	if geoDB != nil {
+		geoDB.Close()
+	}
+}
+
+// geoCountry returns ISO code of IP location, empty if unknown
+func geoCountry(ip net.IP) string {
+	if geoDB == nil {
+		return ""
+	}
+	var record geoRecord
+	if err := geoDB.Lookup(ip, &record); err != nil {
+		slog.Debug("GeoIP lookup failed", "ip", ip, "err", err)
+		return ""
+	}
+	if record.Country.ISOCode != "" {
+		return record.Country.ISOCode
+	}
+	return record.RegisteredCountry.ISOCode
+}
+
+// geoRule adjusts list rule of answer IP by its country. Only new answers are
+// checked: preset IPs and networks, existing routes stay as they are.
+func geoRule(ip net.IP, rule string) string {
+	country := geoCountry(ip)
+	adjusted := countryRule(country, rule)
+	if rule != "" && adjusted == "" {
+		slog.Debug("Proxied domain IP in direct country", "ip", ip, "country", country, "rule", rule)
+	}
+	return adjusted
+}
+
+// countryRule: direct countries are never proxied, proxy countries are proxied
+// even without rule
+func countryRule(country, rule string) string {
+	if country == "" {
+		return rule
+	}
+	if _, direct := geoDirectCountries[country]; direct {
+		return ""
+	}
+	if _, proxied := geoProxyCountries[country]; proxied && rule == "" {
+		return "geoip:" + country
+	}
+	return rule
+}
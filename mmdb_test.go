@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestCountryRule(t *testing.T) {
+	savedProxy, savedDirect := geoProxyCountries, geoDirectCountries
+	t.Cleanup(func() {
+		geoProxyCountries, geoDirectCountries = savedProxy, savedDirect
+	})
+	geoProxyCountries = map[string]struct{}{"US": {}}
+	geoDirectCountries = map[string]struct{}{"RU": {}}
+
+	tests := []struct {
+		country, rule string
+		want          string
+	}{
+		{"", "", ""},
+		{"", "example.com", "example.com"},
+		{"DE", "", ""},
+		{"DE", "example.com", "example.com"},
+		{"US", "", "geoip:US"},
+		{"US", "example.com", "example.com"},
+		{"RU", "", ""},
+		{"RU", "example.com", ""},
+	}
+	for _, tt := range tests {
+		if got := countryRule(tt.country, tt.rule); got != tt.want {
+			t.Errorf("countryRule(%q, %q) = %q, want %q", tt.country, tt.rule, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Everything network related lives in --netns: interface, routes, firewall
+// rules, NFQUEUE, conntrack. Netlink sockets stay in the namespace they were
+// opened in, so it's enough to open them there; commands are started from a
+// thread switched to the namespace.
+
+var (
+	// Namespace from --netns, -1 for the current one
+	targetNs = netns.None()
+	// Netlink handle bound to targetNs
+	nl = &netlink.Handle{}
+)
+
+func setupNetns() {
+	if args.Netns == "" {
+		if args.NetnsKeepSocket {
+			log.Fatal(red("--netns-keep-socket requires --netns"))
+		}
+		return
+	}
+	var err error
+	if strings.Contains(args.Netns, "/") {
+		targetNs, err = netns.GetFromPath(args.Netns)
+	} else {
+		targetNs, err = netns.GetFromName(args.Netns)
+	}
+	if err != nil {
+		log.Fatalf(red("Error:")+" opening network namespace `%s`: %v", args.Netns, err)
+	}
+	nl, err = netlink.NewHandleAt(targetNs)
+	if err != nil {
+		log.Fatalf(red("Error:")+" opening netlink in `%s`: %v", args.Netns, err)
+	}
+	log.Printf("Using network namespace `%s`", args.Netns)
+}
+
+// NetNS for nfqueue.Config, 0 means current namespace
+func nfqueueNetns() int {
+	if targetNs.IsOpen() {
+		return int(targetNs)
+	}
+	return 0
+}
+
+// inNetns runs fn on a thread switched to --netns. Sockets opened and processes
+// started by fn belong to that namespace.
+func inNetns(fn func() error) error {
+	if !targetNs.IsOpen() {
+		return fn()
+	}
+	runtime.LockOSThread()
+	origin, err := netns.Get()
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("getting current network namespace: %v", err)
+	}
+	defer origin.Close()
+	if err := netns.Set(targetNs); err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("entering network namespace `%s`: %v", args.Netns, err)
+	}
+	defer func() {
+		// Callers run on main goroutine, which would stay in --netns
+		if err := netns.Set(origin); err != nil {
+			log.Fatalf(red("Error:")+" leaving network namespace `%s`: %v", args.Netns, err)
+		}
+		runtime.UnlockOSThread()
+	}()
+	return fn()
+}
+
+// procNetExists checks file of /proc/net in --netns. /proc/net shows namespace
+// of the main thread, /proc/thread-self/net of the calling one.
+func procNetExists(name string) bool {
+	if !targetNs.IsOpen() {
+		return fileExists("/proc/net/" + name)
+	}
+	exists := false
+	err := inNetns(func() error {
+		exists = fileExists("/proc/thread-self/net/" + name)
+		return nil
+	})
+	return err == nil && exists
+}
@@ -2,11 +2,10 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"log"
-	"os/exec"
-	"strconv"
-	"strings"
+	"log/slog"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/florianl/go-nfqueue"
@@ -14,104 +13,174 @@ import (
 )
 
 var (
-	proxyIPset = NewIPv4Set(1000)
-	nf         *nfqueue.Nfqueue
+	// Not limited: every address has a route, an evicted one would never be
+	// removed and would make the next route to it fail
+	proxyIPset = NewIPv4Set(0)
+	nfQueues   []*nfqueue.Nfqueue
 	nfCancel   context.CancelFunc
+	// Blocked answers are frequent (ads), daemon shows them only with
+	// --verbose. Replay raises it, so every decision is shown.
+	blockLogLevel = slog.LevelDebug
 )
 
-func setupNfqueue() {
-	config := nfqueue.Config{
-		NfQueue:      NFQUEUE,
-		MaxPacketLen: 0xFFFF,
-		MaxQueueLen:  0xFF,
-		Copymode:     nfqueue.NfQnlCopyPacket,
-		WriteTimeout: 15 * time.Millisecond,
+// Packet waiting for a worker
+type queuedPacket struct {
+	nf      *nfqueue.Nfqueue
+	id      uint32
+	payload []byte
+	// Set by whoever gives the verdict first: worker or deadline timer
+	done *atomic.Bool
+	// Deadline timer, stopped by worker
+	timer *time.Timer
+}
+
+// verdict is given only once, returns false for the second caller
+func (p queuedPacket) verdict(verdict int) bool {
+	if !p.done.CompareAndSwap(false, true) {
+		return false
+	}
+	if err := p.nf.SetVerdict(p.id, verdict); err != nil {
+		slog.Debug("Can't set verdict", "err", err)
 	}
+	return true
+}
 
-	var err error
-	nf, err = nfqueue.Open(&config)
-	if err != nil {
-		log.Fatal("could not open nfqueue socket:", err)
-		return
+// setupNfqueue opens one reader per queue of the range. Readers pass packets to
+// a pool of workers, so one slow answer doesn't hold the whole queue.
+func setupNfqueue() {
+	if args.Queues < 1 || int(NFQUEUE)+args.Queues > 0xFFFF {
+		log.Fatalf(red("Invalid number of queues: ")+"%d", args.Queues)
+	}
+	if args.Workers < 1 {
+		log.Fatalf(red("Invalid number of workers: ")+"%d", args.Workers)
 	}
-	// defer nf.Close()
 
-	// Avoid receiving ENOBUFS errors.
-	if err := nf.SetOption(nfNetlink.NoENOBUFS, true); err != nil {
-		fmt.Printf("failed to set netlink option %v: %v\n",
-			nfNetlink.NoENOBUFS, err)
-		return
+	if args.SyncRoutes && args.VerdictTimeout > 0 && args.RouteTimeout >= args.VerdictTimeout {
+		log.Println(yellow("Warning! --route-timeout is not less than --verdict-timeout, answers may be accepted before routes"))
 	}
 
 	var ctx context.Context
 	ctx, nfCancel = context.WithCancel(context.Background())
-	// defer cancel()
-
-	fn := func(a nfqueue.Attribute) int {
-		id := *a.PacketID
-		nf.SetVerdict(id, processPacket(*a.Payload))
-		return 0
+	packets := make(chan queuedPacket, args.Workers*64)
+	for i := 0; i < args.Workers; i++ {
+		go nfqueueWorker(ctx, packets)
 	}
 
-	err = nf.RegisterWithErrorFunc(ctx, fn, func(e error) int {
-		fmt.Println(err)
-		return -1
-	})
-	if err != nil {
-		if useNFT {
-			log.Println(red("Do you have `nft-queue` kernel module?"))
+	for i := 0; i < args.Queues; i++ {
+		config := nfqueue.Config{
+			NfQueue:      uint16(NFQUEUE + i),
+			MaxPacketLen: 0xFFFF,
+			MaxQueueLen:  args.QueueLen,
+			Copymode:     nfqueue.NfQnlCopyPacket,
+			WriteTimeout: 15 * time.Millisecond,
+			NetNS:        nfqueueNetns(),
+			// Kernel accepts packets instead of dropping when queue is full
+			Flags: nfqueue.NfQaCfgFlagFailOpen,
+		}
+
+		nf, err := nfqueue.Open(&config)
+		if err != nil {
+			log.Fatal("could not open nfqueue socket:", err)
+			return
+		}
+		nfQueues = append(nfQueues, nf)
+
+		// Avoid receiving ENOBUFS errors.
+		if err := nf.SetOption(nfNetlink.NoENOBUFS, true); err != nil {
+			slog.Error("Failed to set netlink option", "option", nfNetlink.NoENOBUFS, "err", err)
+			return
+		}
+
+		fn := func(a nfqueue.Attribute) int {
+			// Payload belongs to the netlink message, keep own copy for worker
+			p := queuedPacket{
+				nf:      nf,
+				id:      *a.PacketID,
+				payload: append([]byte(nil), *a.Payload...),
+				done:    &atomic.Bool{},
+			}
+			if args.VerdictTimeout > 0 {
+				deadline := p
+				p.timer = time.AfterFunc(args.VerdictTimeout, func() {
+					deadline.verdict(nfqueue.NfAccept)
+				})
+			}
+			pendingPackets.Add(1)
+			packets <- p
+			return 0
+		}
+
+		err = nf.RegisterWithErrorFunc(ctx, fn, func(e error) int {
+			slog.Error("NFQUEUE error", "queue", config.NfQueue, "err", e)
+			return -1
+		})
+		if err != nil {
+			if _, ok := firewall.(*nftFirewall); ok {
+				log.Println(red("Do you have `nft-queue` kernel module?"))
+			}
+			log.Fatal("Can't register NFQUEUE func: ", err)
 		}
-		log.Fatal("Can't register NFQUEUE func: ", err)
 	}
 
-	if useNFT {
-		execCommand("nft add table ip dnsr-nf")
-		execCommand("nft add chain ip dnsr-nf input { type filter hook input priority 0 \\; }")
-		execCommand("nft add chain ip dnsr-nf forward { type filter hook forward priority 0 \\; }")
-		execCommand("nft add chain ip dnsr-nf output { type filter hook output priority 0 \\; }")
-		execCommand("nft add rule ip dnsr-nf input udp sport 53 queue num ", strconv.Itoa(NFQUEUE))
-		execCommand("nft add rule ip dnsr-nf forward udp sport 53 queue num ", strconv.Itoa(NFQUEUE))
-		execCommand("nft add rule ip dnsr-nf output udp sport 53 queue num ", strconv.Itoa(NFQUEUE))
+	if err := installQueueRules(); err != nil {
+		log.Fatal(red("Error: "), err)
+	}
+	if args.Queues == 1 {
+		log.Printf(green("NFQUEUE `%d` successfully configured"), NFQUEUE)
 	} else {
-		execCommand("iptables -I INPUT -p udp --sport 53 -j NFQUEUE --queue-num", strconv.Itoa(NFQUEUE))
-		execCommand("iptables -I FORWARD -p udp --sport 53 -j NFQUEUE --queue-num", strconv.Itoa(NFQUEUE))
-		execCommand("iptables -I OUTPUT -p udp --sport 53 -j NFQUEUE --queue-num", strconv.Itoa(NFQUEUE))
+		log.Printf(green("NFQUEUE `%d-%d` successfully configured, %d workers"), NFQUEUE, NFQUEUE+args.Queues-1, args.Workers)
+	}
+}
+
+func nfqueueWorker(ctx context.Context, packets <-chan queuedPacket) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-packets:
+			// Late answer is processed anyway: client got it and routes are needed
+			verdict := processPacket(p.payload)
+			if p.timer != nil {
+				p.timer.Stop()
+			}
+			if !p.verdict(verdict) {
+				slog.Debug("Verdict deadline exceeded, answer was accepted", "id", p.id)
+			}
+			pendingPackets.Add(-1)
+			lastProgress.Store(time.Now().UnixNano())
+		}
 	}
-	log.Printf(green("NFQUEUE `%d` successfully configured"), NFQUEUE)
 }
 
 func removeNfqueue() {
-	if nf != nil {
+	if nfCancel != nil {
 		nfCancel()
+	}
+	// Otherwise it puts removed rules back
+	stopWatchdog()
+	queueRulesMu.Lock()
+	defer queueRulesMu.Unlock()
+	for _, nf := range nfQueues {
 		nf.Close()
 	}
-	if !useNFT {
-		output, err := exec.Command("sh", "-c", "iptables -L -n -v").Output()
-		if err == nil {
-			if strings.Contains(string(output), "NFQUEUE num "+strconv.Itoa(NFQUEUE)) {
-				execCommand("iptables -D INPUT -p udp --sport 53 -j NFQUEUE --queue-num", strconv.Itoa(NFQUEUE))
-				execCommand("iptables -D FORWARD -p udp --sport 53 -j NFQUEUE --queue-num", strconv.Itoa(NFQUEUE))
-				execCommand("iptables -D OUTPUT -p udp --sport 53 -j NFQUEUE --queue-num", strconv.Itoa(NFQUEUE))
-				log.Printf(green("NFQUEUE `%d` cleanup completed"), NFQUEUE)
-				return
-			}
-			log.Printf("NFQUEUE `%d` not found, nothing cleanup", NFQUEUE)
-		} else {
-			log.Fatal(err)
-		}
-	} else {
-		output, err := exec.Command("sh", "-c", "nft list tables").Output()
-		if err == nil {
-			if strings.Contains(string(output), "dnsr-nf") {
-				execCommand("nft delete table dnsr-nf")
-				log.Printf(green("NFQUEUE `%d` cleanup completed"), NFQUEUE)
-				return
-			}
-			log.Printf("NFQUEUE `%d` not found, nothing cleanup", NFQUEUE)
-		} else {
-			log.Fatal(err)
-		}
+	first, count := queueFirst, queueCount
+	if count == 0 {
+		// Nothing installed by this run, look for rules left by previous one
+		first, count = NFQUEUE, uint16(args.Queues)
+	}
+	found, err := firewall.HasQueue(first, count)
+	if err != nil {
+		log.Fatal(err)
 	}
+	if !found {
+		slog.Info("NFQUEUE not found, nothing cleanup", "queue", first)
+		return
+	}
+	if err := firewall.RemoveQueue(first, count); err != nil {
+		log.Fatal(red("Error: "), err)
+	}
+	queueRulesInstalled = false
+	slog.Info(green("NFQUEUE cleanup completed"), "queue", first)
 }
 
 // processPacket обрабатывает перехваченный пакет
@@ -119,46 +188,115 @@ func processPacket(packet []byte) int {
 	dnsPayload, err := extractUdpPayload(packet)
 	if err != nil {
 		// Not a DNS-answer
-		if args.Verbose {
-			log.Printf("Received bad DNS-package")
-		}
+		slog.Debug("Received bad DNS-package", "err", err)
 		return nfqueue.NfAccept // TODO or drop?
 	}
+	verdict, _ := processAnswer(packetDst(packet), dnsPayload)
+	return verdict
+}
+
+// processAnswer decides what to do with DNS answer for client: block, proxy
+// (routes are added here) or pass directly. Returns verdict and decision as
+// written to query log, empty for answers which can't be parsed.
+func processAnswer(client net.IP, dnsPayload []byte) (int, string) {
 	dnsResponse := parseDNSResponse(dnsPayload)
 
 	// Block?
-	for name, _ := range dnsResponse {
-		_, blocked := blockedDomains[name]
-		if blocked || checkPatterns(name, blockedPatterns) != "" {
-			if args.Verbose {
-				log.Printf("Blocking DNS-answer for %s", name)
+	for name := range dnsResponse.ips {
+		if rule := blockRule(name); rule != "" {
+			slog.Log(context.Background(), blockLogLevel, "Blocking DNS-answer", "domain", name,
+				"client", client, "list", "block", "rule", rule, "verdict", "block")
+			logQuery(client, dnsResponse, "block")
+			if args.BlackholeBlocked {
+				blackholeAnswer(dnsResponse)
 			}
-			return nfqueue.NfDrop
+			return nfqueue.NfDrop, "block"
 		}
 
 	}
 
-	for name, ipList := range dnsResponse {
-		trimmedDomain := trimDomain(name)
-		_, proxied := proxiedDomains[trimmedDomain]
-		// Proxy?
-		if proxied || checkPatterns(name, proxiedPatterns) != "" {
-			for _, ip := range ipList {
-				if proxyIPset.Add(ip) {
-					go addRoute(ip)
-					if !args.Silent {
-						log.Printf("New proxy route %s :: %v", name, ip)
-					}
-				} else if args.Verbose {
-					log.Printf("Old proxy route %s :: %v", name, ip)
-				}
+	// Forged answer for proxied domain? Genuine one will come later.
+	if len(stubNets) > 0 || len(suspiciousTTLs) > 0 {
+		for name := range dnsResponse.ips {
+			if !isProxied(name) {
+				continue
 			}
-		} else { // Direct
-			if args.Verbose {
-				log.Printf("Direct %s :: %v\n", name, ipList)
+			if reason := injectionReason(dnsResponse); reason != "" {
+				if passiveMode() {
+					injectedIgnored.Add(1)
+					slog.Warn("Ignoring injected DNS-answer", "domain", name, "client", client,
+						"reason", reason, "injected", injectedIgnored.Load())
+					logQuery(client, dnsResponse, "injected")
+					return nfqueue.NfAccept, "injected"
+				}
+				injectedCount.Add(1)
+				slog.Warn("Dropping injected DNS-answer", "domain", name, "client", client,
+					"reason", reason, "verdict", "drop", "injected", injectedCount.Load())
+				logQuery(client, dnsResponse, "injected")
+				return nfqueue.NfDrop, "injected"
 			}
+			break
 		}
 	}
 
-	return nfqueue.NfAccept
+	decision := "direct"
+	var newIPs []net.IP
+	var waits []chan struct{}
+	for name, ipList := range dnsResponse.ips {
+		domainRule := proxyRule(name)
+		var directIPs []net.IP
+		for _, ip := range ipList {
+			// Proxy?
+			rule, list := domainRule, "proxy"
+			if geoDB != nil {
+				rule = geoRule(ip, domainRule)
+				if rule != domainRule {
+					list = "geoip"
+				}
+			}
+			if rule == "" {
+				directIPs = append(directIPs, ip)
+				continue
+			}
+
+			decision = "proxy"
+			if wgEndpointIPs.Exists(ip) {
+				slog.Debug("Skip WireGuard endpoint", "domain", name, "ip", ip)
+				continue
+			}
+			// More specific route would bypass --block-ips
+			if blockNetsContain(ip) {
+				slog.Debug("Skip blocked IP", "domain", name, "ip", ip, "list", "block-ips")
+				continue
+			}
+			added, wait := claimRoute(ip)
+			if wait != nil {
+				waits = append(waits, wait)
+			}
+			proxyIPset.Record(ip, name, dnsResponse.chain(name))
+			if added {
+				newIPs = append(newIPs, ip)
+				if !args.Silent {
+					slog.Info("New proxy route", "domain", name, "ip", ip, "client", client,
+						"list", list, "rule", rule, "verdict", "proxy")
+				}
+			} else {
+				slog.Debug("Old proxy route", "domain", name, "ip", ip, "client", client, "verdict", "proxy")
+			}
+		}
+		// Direct
+		if len(directIPs) > 0 {
+			slog.Debug("Direct", "domain", name, "ip", directIPs, "client", client, "verdict", "direct")
+			if detector != nil {
+				detector.noteDirect(name, directIPs)
+			}
+		}
+	}
+	installRoutes(newIPs, addProxyRoute, waits)
+	if dnsResponse.question == "" {
+		return nfqueue.NfAccept, ""
+	}
+	// Answers without addresses (NXDOMAIN, AAAA...) are logged as direct too
+	logQuery(client, dnsResponse, decision)
+	return nfqueue.NfAccept, decision
 }
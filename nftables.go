@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"golang.org/x/sys/unix"
+)
+
+// Tables are managed through nftables netlink messages directly, without `nft`
+// binary. Every change is committed as a single batch, so a half-configured
+// ruleset can't be left behind.
+
+const (
+	NFT_QUEUE_TABLE = "dnsr-nf"
+	NFT_NAT_TABLE   = "dnsr-nat"
+)
+
+// nftConn connects to nftables of --netns
+func nftConn() (*nftables.Conn, error) {
+	if targetNs.IsOpen() {
+		return nftables.New(nftables.WithNetNSFd(int(targetNs)))
+	}
+	return nftables.New()
+}
+
+// nftListTables returns IPv4 tables. Error means nftables is not usable at all.
+func nftListTables() ([]*nftables.Table, error) {
+	conn, err := nftConn()
+	if err != nil {
+		return nil, err
+	}
+	return conn.ListTablesOfFamily(nftables.TableFamilyIPv4)
+}
+
+func nftTableExists(name string) (bool, error) {
+	tables, err := nftListTables()
+	if err != nil {
+		return false, err
+	}
+	for _, table := range tables {
+		if table.Name == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type nftFirewall struct{}
+
+func (*nftFirewall) Name() string {
+	return "nftables"
+}
+
+// InstallQueue creates table with `udp sport 53 queue num a-b fanout` rules in
+// input, forward and output hooks
+func (*nftFirewall) InstallQueue(first, count uint16) error {
+	conn, err := nftConn()
+	if err != nil {
+		return err
+	}
+	table := conn.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyIPv4,
+		Name:   NFT_QUEUE_TABLE,
+	})
+	hooks := []struct {
+		name string
+		hook *nftables.ChainHook
+	}{
+		{"input", nftables.ChainHookInput},
+		{"forward", nftables.ChainHookForward},
+		{"output", nftables.ChainHookOutput},
+	}
+	for _, h := range hooks {
+		chain := conn.AddChain(&nftables.Chain{
+			Name:     h.name,
+			Table:    table,
+			Type:     nftables.ChainTypeFilter,
+			Hooknum:  h.hook,
+			Priority: nftables.ChainPriorityFilter,
+		})
+		conn.AddRule(&nftables.Rule{
+			Table: table,
+			Chain: chain,
+			Exprs: append(matchUdpSport(53), nftQueue(first, count)),
+		})
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("can't create table %s: %v", NFT_QUEUE_TABLE, err)
+	}
+	return nil
+}
+
+func (*nftFirewall) RemoveQueue(first, count uint16) error {
+	_, err := nftDeleteTable(NFT_QUEUE_TABLE)
+	return err
+}
+
+func (*nftFirewall) HasQueue(first, count uint16) (bool, error) {
+	return nftTableExists(NFT_QUEUE_TABLE)
+}
+
+// Masquerade creates table with `oifname <name> masquerade` rule
+func (*nftFirewall) Masquerade(name string) error {
+	conn, err := nftConn()
+	if err != nil {
+		return err
+	}
+	table := conn.AddTable(&nftables.Table{
+		Family: nftables.TableFamilyIPv4,
+		Name:   NFT_NAT_TABLE,
+	})
+	chain := conn.AddChain(&nftables.Chain{
+		Name:     "postrouting",
+		Table:    table,
+		Type:     nftables.ChainTypeNAT,
+		Hooknum:  nftables.ChainHookPostrouting,
+		Priority: nftables.ChainPriorityNATSource,
+	})
+	conn.AddRule(&nftables.Rule{
+		Table: table,
+		Chain: chain,
+		Exprs: []expr.Any{
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifname(name)},
+			&expr.Masq{},
+		},
+	})
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("can't create table %s: %v", NFT_NAT_TABLE, err)
+	}
+	return nil
+}
+
+func (*nftFirewall) RemoveMasquerade(name string) error {
+	_, err := nftDeleteTable(NFT_NAT_TABLE)
+	return err
+}
+
+// nftDeleteTable removes table if it exists. Returns true if it was removed.
+func nftDeleteTable(name string) (bool, error) {
+	exists, err := nftTableExists(name)
+	if err != nil || !exists {
+		return false, err
+	}
+	conn, err := nftConn()
+	if err != nil {
+		return false, err
+	}
+	conn.DelTable(&nftables.Table{
+		Family: nftables.TableFamilyIPv4,
+		Name:   name,
+	})
+	if err := conn.Flush(); err != nil {
+		return false, fmt.Errorf("can't delete table %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// Bypass: packets are accepted while nobody listens on the queue
+func nftQueue(first, count uint16) *expr.Queue {
+	if count <= 1 {
+		return &expr.Queue{Num: first, Flag: expr.QueueFlagBypass}
+	}
+	return &expr.Queue{Num: first, Total: count, Flag: expr.QueueFlagBypass | expr.QueueFlagFanout}
+}
+
+// `udp sport <port>`
+func matchUdpSport(port uint16) []expr.Any {
+	return []expr.Any{
+		&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{unix.IPPROTO_UDP}},
+		&expr.Payload{
+			DestRegister: 1,
+			Base:         expr.PayloadBaseTransportHeader,
+			Offset:       0,
+			Len:          2,
+		},
+		&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: binaryutil.BigEndian.PutUint16(port)},
+	}
+}
+
+// Interface names are compared as zero-padded IFNAMSIZ buffers
+func ifname(name string) []byte {
+	b := make([]byte, unix.IFNAMSIZ)
+	copy(b, name)
+	return b
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Minimal pcap/pcapng reader, just enough to get IPv4 packets out of captures
+// made by tcpdump or wireshark
+
+const (
+	pcapMagic       = 0xa1b2c3d4
+	pcapMagicNano   = 0xa1b23c4d
+	pcapngSHB       = 0x0a0d0d0a
+	pcapngIDB       = 0x00000001
+	pcapngSPB       = 0x00000003
+	pcapngEPB       = 0x00000006
+	pcapngByteMagic = 0x1a2b3c4d
+)
+
+// Link types
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkRawAlt   = 12
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkSLL2     = 276
+)
+
+// Larger records are from broken files, tcpdump snaplen is at most 256 KiB
+const maxCaptureRecord = 256 * 1024
+
+// readCapture calls fn for every IPv4 packet in pcap or pcapng file.
+// Non-IPv4 frames are skipped.
+func readCapture(path string, fn func(packet []byte)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r := bufio.NewReader(file)
+	magic, err := r.Peek(4)
+	if err != nil {
+		return fmt.Errorf("too short for capture file: %v", err)
+	}
+	if binary.LittleEndian.Uint32(magic) == pcapngSHB {
+		return readPcapng(r, fn)
+	}
+	return readPcap(r, fn)
+}
+
+func readPcap(r io.Reader, fn func(packet []byte)) error {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("can't read pcap header: %v", err)
+	}
+	var order binary.ByteOrder
+	switch {
+	case isMagic(binary.LittleEndian.Uint32(header), pcapMagic, pcapMagicNano):
+		order = binary.LittleEndian
+	case isMagic(binary.BigEndian.Uint32(header), pcapMagic, pcapMagicNano):
+		order = binary.BigEndian
+	default:
+		return fmt.Errorf("unknown capture file format")
+	}
+	linkType := order.Uint32(header[20:24]) & 0x0FFFFFFF
+
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("can't read pcap record: %v", err)
+		}
+		caplen := order.Uint32(record[8:12])
+		if caplen > maxCaptureRecord {
+			return fmt.Errorf("bad pcap record length %d", caplen)
+		}
+		data := make([]byte, caplen)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("can't read pcap record: %v", err)
+		}
+		if packet := linkPayload(linkType, data); packet != nil {
+			fn(packet)
+		}
+	}
+}
+
+func readPcapng(r io.Reader, fn func(packet []byte)) error {
+	var order binary.ByteOrder = binary.LittleEndian
+	var linkTypes []uint32
+
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("can't read pcapng block: %v", err)
+		}
+		blockType := order.Uint32(header[0:4])
+		if blockType == pcapngSHB {
+			// Byte order is only known after reading the magic
+			magic := make([]byte, 4)
+			if _, err := io.ReadFull(r, magic); err != nil {
+				return fmt.Errorf("can't read pcapng section: %v", err)
+			}
+			if binary.LittleEndian.Uint32(magic) == pcapngByteMagic {
+				order = binary.LittleEndian
+			} else if binary.BigEndian.Uint32(magic) == pcapngByteMagic {
+				order = binary.BigEndian
+			} else {
+				return fmt.Errorf("bad pcapng byte order magic")
+			}
+			length := order.Uint32(header[4:8])
+			if length < 16 {
+				return fmt.Errorf("bad pcapng section length %d", length)
+			}
+			if _, err := io.CopyN(io.Discard, r, int64(length-12)); err != nil {
+				return fmt.Errorf("can't read pcapng section: %v", err)
+			}
+			// Interfaces are numbered per section
+			linkTypes = linkTypes[:0]
+			continue
+		}
+
+		length := order.Uint32(header[4:8])
+		if length < 12 || length%4 != 0 || length > maxCaptureRecord+64 {
+			return fmt.Errorf("bad pcapng block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return fmt.Errorf("can't read pcapng block: %v", err)
+		}
+		body = body[:len(body)-4] // trailing length
+
+		switch blockType {
+		case pcapngIDB:
+			if len(body) < 2 {
+				return fmt.Errorf("bad pcapng interface block")
+			}
+			linkTypes = append(linkTypes, uint32(order.Uint16(body[0:2])))
+		case pcapngEPB:
+			if len(body) < 20 {
+				return fmt.Errorf("bad pcapng packet block")
+			}
+			iface := order.Uint32(body[0:4])
+			captured := order.Uint32(body[12:16])
+			if int(iface) >= len(linkTypes) || int(captured) > len(body)-20 {
+				return fmt.Errorf("bad pcapng packet block")
+			}
+			if packet := linkPayload(linkTypes[iface], body[20:20+captured]); packet != nil {
+				fn(packet)
+			}
+		case pcapngSPB:
+			if len(body) < 4 || len(linkTypes) == 0 {
+				return fmt.Errorf("bad pcapng packet block")
+			}
+			captured := min(int(order.Uint32(body[0:4])), len(body)-4)
+			if packet := linkPayload(linkTypes[0], body[4:4+captured]); packet != nil {
+				fn(packet)
+			}
+		}
+	}
+}
+
+func isMagic(v uint32, magics ...uint32) bool {
+	for _, m := range magics {
+		if v == m {
+			return true
+		}
+	}
+	return false
+}
+
+// linkPayload strips link layer header. Returns nil if frame isn't IPv4.
+func linkPayload(linkType uint32, data []byte) []byte {
+	switch linkType {
+	case linkRaw, linkRawAlt, linkIPv4:
+		if len(data) > 0 && data[0]>>4 == 4 {
+			return data
+		}
+	case linkNull:
+		// Address family in host byte order, AF_INET is 2 everywhere
+		if len(data) >= 4 && (binary.LittleEndian.Uint32(data) == 2 || binary.BigEndian.Uint32(data) == 2) {
+			return data[4:]
+		}
+	case linkEthernet:
+		if len(data) < 14 {
+			return nil
+		}
+		etherType := binary.BigEndian.Uint16(data[12:14])
+		data = data[14:]
+		// Skip VLAN tags
+		for (etherType == 0x8100 || etherType == 0x88a8) && len(data) >= 4 {
+			etherType = binary.BigEndian.Uint16(data[2:4])
+			data = data[4:]
+		}
+		if etherType == 0x0800 {
+			return data
+		}
+	case linkSLL:
+		if len(data) >= 16 && binary.BigEndian.Uint16(data[14:16]) == 0x0800 {
+			return data[16:]
+		}
+	case linkSLL2:
+		if len(data) >= 20 && binary.BigEndian.Uint16(data[0:2]) == 0x0800 {
+			return data[20:]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Preset files contain, one per line:
+//
+//	1.2.3.4                  single IP
+//	10.0.0.0/8               network
+//	10.0.0.1-10.0.0.99       range
+//	AS13335                  all prefixes of autonomous system, from --asn-db
+//
+// Networks, ranges and AS prefixes are merged into the minimal set of routes.
+// Single IPs get own routes, unless a network covers them.
+
+// IPv4 range, inclusive
+type ipRange struct {
+	first, last uint32
+}
+
+// Single preset IP with the file it came from
+type presetIP struct {
+	ip     net.IP
+	source string
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(v uint32) net.IP {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func netToRange(n *net.IPNet) ipRange {
+	first := ipToUint(n.IP.Mask(n.Mask))
+	ones, _ := n.Mask.Size()
+	return ipRange{first, first | uint32(uint64(1)<<(32-ones)-1)}
+}
+
+func (r ipRange) contains(v uint32) bool {
+	return r.first <= v && v <= r.last
+}
+
+// nets splits range into the minimal list of CIDRs
+func (r ipRange) nets() []*net.IPNet {
+	var nets []*net.IPNet
+	for first := uint64(r.first); first <= uint64(r.last); {
+		// Largest block aligned at first and not exceeding last
+		size := 32 - bits.Len64(uint64(r.last)-first+1) + 1
+		if align := bits.TrailingZeros32(uint32(first)); first != 0 && 32-align > size {
+			size = 32 - align
+		}
+		nets = append(nets, &net.IPNet{IP: uintToIP(uint32(first)), Mask: net.CIDRMask(size, 32)})
+		first += uint64(1) << (32 - size)
+	}
+	return nets
+}
+
+// mergeRanges sorts ranges and joins overlapping and adjacent ones
+func mergeRanges(ranges []ipRange) []ipRange {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first < ranges[j].first
+	})
+	merged := []ipRange{ranges[0]}
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if uint64(r.first) <= uint64(last.last)+1 {
+			last.last = max(last.last, r.last)
+		} else {
+			merged = append(merged, r)
+		}
+	}
+	return merged
+}
+
+// excludeIP cuts IP out of merged ranges
+func excludeIP(ranges []ipRange, ip net.IP) []ipRange {
+	v := ipToUint(ip)
+	var result []ipRange
+	for _, r := range ranges {
+		if !r.contains(v) {
+			result = append(result, r)
+			continue
+		}
+		if r.first < v {
+			result = append(result, ipRange{r.first, v - 1})
+		}
+		if v < r.last {
+			result = append(result, ipRange{v + 1, r.last})
+		}
+	}
+	return result
+}
+
+// parsePresetLine returns IP, range or ASN of the line
+func parsePresetLine(line string) (ip net.IP, r *ipRange, asn uint32, err error) {
+	if number, found := strings.CutPrefix(strings.ToUpper(line), "AS"); found {
+		v, err := strconv.ParseUint(number, 10, 32)
+		if err != nil {
+			return nil, nil, 0, fmt.Errorf("bad ASN")
+		}
+		return nil, nil, uint32(v), nil
+	}
+	if strings.Contains(line, "/") {
+		_, n, err := net.ParseCIDR(line)
+		if err != nil || n.IP.To4() == nil {
+			return nil, nil, 0, fmt.Errorf("bad IPv4 network")
+		}
+		r := netToRange(n)
+		if r.first == r.last {
+			return uintToIP(r.first), nil, 0, nil
+		}
+		return nil, &r, 0, nil
+	}
+	if from, to, found := strings.Cut(line, "-"); found {
+		first := net.ParseIP(strings.TrimSpace(from)).To4()
+		last := net.ParseIP(strings.TrimSpace(to)).To4()
+		if first == nil || last == nil || ipToUint(first) > ipToUint(last) {
+			return nil, nil, 0, fmt.Errorf("bad IPv4 range")
+		}
+		return nil, &ipRange{ipToUint(first), ipToUint(last)}, 0, nil
+	}
+	ip = net.ParseIP(line)
+	if ip == nil {
+		return nil, nil, 0, fmt.Errorf("bad IP")
+	}
+	return ip, nil, 0, nil
+}
+
+// loadASNPrefixes reads IPv4 prefixes of wanted ASNs from database, one of:
+//
+//	1.0.0.0/24 13335            prefix and ASN
+//	1.0.0.0 24 13335            routeviews pfx2as
+//	1.0.0.0 1.0.0.255 13335 ... iptoasn.com ip2asn-v4.tsv
+func loadASNPrefixes(db string, wanted map[uint32]struct{}) ([]ipRange, error) {
+	file, err := os.Open(db)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ranges []ipRange
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var r ipRange
+		var asnField string
+		if _, n, err := net.ParseCIDR(fields[0]); err == nil {
+			if n.IP.To4() == nil {
+				continue
+			}
+			r, asnField = netToRange(n), fields[1]
+		} else if len(fields) >= 3 {
+			first := net.ParseIP(fields[0]).To4()
+			if first == nil {
+				continue
+			}
+			if last := net.ParseIP(fields[1]).To4(); last != nil {
+				r = ipRange{ipToUint(first), ipToUint(last)}
+			} else if ones, err := strconv.Atoi(fields[1]); err == nil && ones >= 0 && ones <= 32 {
+				r = netToRange(&net.IPNet{IP: first, Mask: net.CIDRMask(ones, 32)})
+			} else {
+				continue
+			}
+			asnField = fields[2]
+		} else {
+			continue
+		}
+
+		// pfx2as uses `_` for multi-origin prefixes
+		for _, field := range strings.FieldsFunc(asnField, func(c rune) bool { return c == '_' || c == ',' }) {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(field), "AS"), 10, 32)
+			if err != nil {
+				continue
+			}
+			if _, exists := wanted[uint32(asn)]; exists {
+				ranges = append(ranges, r)
+				break
+			}
+		}
+	}
+	return ranges, scanner.Err()
+}
+
+// readPresets parses preset sources into single IPs and merged ranges
+func readPresets(sources string) ([]presetIP, []ipRange) {
+	var ips []presetIP
+	var ranges []ipRange
+	asns := make(map[uint32]struct{})
+	for _, source := range strings.Split(sources, ";") {
+		source = strings.TrimSpace(source)
+		if source == "" {
+			continue
+		}
+		if file, code, ok := geoReference(source); ok {
+			nets, err := loadGeoIP(file, code)
+			if err != nil {
+				log.Fatalf(red("Error")+" reading %s: %v", source, err)
+			}
+			for _, n := range nets {
+				ranges = append(ranges, netToRange(n))
+			}
+			continue
+		}
+		file, err := os.Open(source)
+		if err != nil {
+			log.Fatalf(red("Error")+" opening file %s: %v", source, err)
+			continue
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			// Remove comment
+			if idx := strings.Index(line, "#"); idx != -1 {
+				line = line[:idx]
+			}
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+			ip, r, asn, err := parsePresetLine(line)
+			switch {
+			case err != nil:
+				log.Printf(yellow("Can't parse line in %s: ")+"%s (%v)", source, line, err)
+			case asn != 0:
+				asns[asn] = struct{}{}
+			case r != nil:
+				ranges = append(ranges, *r)
+			default:
+				ips = append(ips, presetIP{ip, source})
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Fatalf(red("Error")+" reading file %s: %v", source, err)
+		}
+	}
+
+	if len(asns) > 0 {
+		if args.ASNDatabase == "" {
+			log.Fatal(red("Error:") + " IP lists have AS numbers, specify --asn-db")
+		}
+		asnRanges, err := loadASNPrefixes(args.ASNDatabase, asns)
+		if err != nil {
+			log.Fatalf(red("Error")+" reading %s: %v", args.ASNDatabase, err)
+		}
+		if len(asnRanges) == 0 {
+			log.Printf(yellow("No prefixes found for %d AS numbers in %s"), len(asns), args.ASNDatabase)
+		}
+		ranges = append(ranges, asnRanges...)
+	}
+	return ips, mergeRanges(ranges)
+}
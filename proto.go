@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf messages (dnstap) are few and small, so they are decoded by hand
+// instead of generated code.
+
+// protoField is a decoded field: bytes for length-delimited, num for the rest
+type protoField struct {
+	num   protowire.Number
+	typ   protowire.Type
+	bytes []byte
+	value uint64
+}
+
+// walkProto calls fn for every field of the message until fn returns false
+func walkProto(b []byte, fn func(f protoField) bool) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return fmt.Errorf("bad protobuf tag: %v", protowire.ParseError(n))
+		}
+		b = b[n:]
+		f := protoField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.value, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.value = uint64(v)
+		case protowire.Fixed64Type:
+			f.value, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return fmt.Errorf("bad protobuf field %d: %v", num, protowire.ParseError(n))
+		}
+		b = b[n:]
+		if !fn(f) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexflint/go-arg"
+)
+
+// Query log is JSON lines file with every processed DNS answer. It's rotated by
+// size and old files are removed by age, to not wear out router flash.
+
+type QueryLogArgs struct {
+	QueryLog string `arg:"--query-log" help:"File to log every DNS answer to, rotated files get .1, .2... suffixes"`
+}
+
+type queryLogEntry struct {
+	Time     time.Time         `json:"time"`
+	Client   string            `json:"client"`
+	Question string            `json:"question"`
+	Type     string            `json:"type,omitempty"`
+	RCode    string            `json:"rcode,omitempty"`
+	IPs      []string          `json:"ips,omitempty"`
+	CNAMEs   map[string]string `json:"cnames,omitempty"`
+	Decision string            `json:"decision"`
+}
+
+type queryLogger struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	// Answers may still be processed while shutting down, closed guards entries
+	mu      sync.RWMutex
+	closed  bool
+	entries chan *queryLogEntry
+	done    chan struct{}
+	file    *os.File
+	writer  *bufio.Writer
+	size    int64
+}
+
+var queryLog *queryLogger
+
+func startQueryLog() {
+	if args.QueryLog == "" {
+		return
+	}
+	queryLog = &queryLogger{
+		path:     args.QueryLog,
+		maxSize:  int64(args.QueryLogSize) * 1024,
+		maxAge:   args.QueryLogAge,
+		maxFiles: args.QueryLogFiles,
+		entries:  make(chan *queryLogEntry, 256),
+		done:     make(chan struct{}),
+	}
+	if err := queryLog.open(); err != nil {
+		log.Fatalf(red("Error")+" opening query log: %v", err)
+	}
+	go queryLog.run()
+	log.Printf("Logging DNS answers to %s", args.QueryLog)
+}
+
+func stopQueryLog() {
+	if queryLog != nil {
+		queryLog.mu.Lock()
+		queryLog.closed = true
+		close(queryLog.entries)
+		queryLog.mu.Unlock()
+		<-queryLog.done
+	}
+}
+
+// logQuery never blocks packet processing, entries are dropped if writer is behind.
+// Client is nil when unknown, e.g. for upstream answers from dnstap.
+func logQuery(client net.IP, response *DNSResponse, decision string) {
+	if queryLog == nil {
+		return
+	}
+	entry := &queryLogEntry{
+		Time:     time.Now(),
+		Question: response.question,
+		Type:     response.qtype,
+		RCode:    response.rcode,
+		Decision: decision,
+	}
+	if client != nil {
+		entry.Client = client.String()
+	}
+	seen := make(map[string]struct{})
+	for _, ipList := range response.ips {
+		for _, ip := range ipList {
+			ipStr := ip.String()
+			if _, exists := seen[ipStr]; !exists {
+				seen[ipStr] = struct{}{}
+				entry.IPs = append(entry.IPs, ipStr)
+			}
+		}
+	}
+	sort.Strings(entry.IPs)
+	if len(response.cnames) > 0 {
+		entry.CNAMEs = response.cnames
+	}
+	queryLog.mu.RLock()
+	defer queryLog.mu.RUnlock()
+	if queryLog.closed {
+		return
+	}
+	select {
+	case queryLog.entries <- entry:
+	default:
+	}
+}
+
+func (q *queryLogger) open() error {
+	file, err := os.OpenFile(q.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	q.file = file
+	q.writer = bufio.NewWriter(file)
+	q.size = stat.Size()
+	return nil
+}
+
+func (q *queryLogger) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry, ok := <-q.entries:
+			if !ok {
+				q.writer.Flush()
+				q.file.Close()
+				return
+			}
+			q.write(entry)
+		case <-ticker.C:
+			q.writer.Flush()
+		}
+	}
+}
+
+func (q *queryLogger) write(entry *queryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	if q.maxSize > 0 && q.size+int64(len(line)) > q.maxSize && q.size > 0 {
+		if err := q.rotate(); err != nil {
+			slog.Error("Can't rotate query log", "err", err)
+		}
+	}
+	n, _ := q.writer.Write(line)
+	q.size += int64(n)
+}
+
+// rotate shifts path -> path.1 -> path.2 ... and removes files beyond limits.
+// Without rotated files the log starts over.
+func (q *queryLogger) rotate() error {
+	q.writer.Flush()
+	if q.maxFiles <= 0 {
+		if err := q.file.Truncate(0); err != nil {
+			return err
+		}
+		q.size = 0
+		return nil
+	}
+	q.file.Close()
+
+	os.Remove(rotatedLog(q.path, q.maxFiles))
+	for i := q.maxFiles - 1; i >= 0; i-- {
+		os.Rename(rotatedLog(q.path, i), rotatedLog(q.path, i+1))
+	}
+	if q.maxAge > 0 {
+		for i := 1; i <= q.maxFiles; i++ {
+			stat, err := os.Stat(rotatedLog(q.path, i))
+			if err == nil && time.Since(stat.ModTime()) > q.maxAge {
+				os.Remove(rotatedLog(q.path, i))
+			}
+		}
+	}
+	return q.open()
+}
+
+func rotatedLog(path string, n int) string {
+	if n == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+type LogArgs struct {
+	Domain   string `arg:"-d,--domain" help:"Show only answers for this domain or its subdomains"`
+	Client   string `arg:"-c,--client" help:"Show only answers to this client IP"`
+	Decision string `arg:"--decision" help:"Show only answers with this decision: proxy, block, injected or direct"`
+	QueryLogArgs
+}
+
+// logCommand prints query log entries, oldest first
+func logCommand(argv []string) {
+	var logArgs LogArgs
+	parser, err := arg.NewParser(arg.Config{Program: "dnsr log"}, &logArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parser.MustParse(argv)
+	if logArgs.QueryLog == "" {
+		parser.Fail("--query-log is required")
+	}
+	domain := strings.ToLower(strings.TrimSuffix(logArgs.Domain, "."))
+
+	var files []string
+	for i := 1; fileExists(rotatedLog(logArgs.QueryLog, i)); i++ {
+		files = append([]string{rotatedLog(logArgs.QueryLog, i)}, files...)
+	}
+	files = append(files, logArgs.QueryLog)
+
+	for _, path := range files {
+		file, err := os.Open(path)
+		if err != nil {
+			log.Fatalf(red("Error")+" opening file %s: %v", path, err)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry queryLogEntry
+			if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+				continue
+			}
+			if logArgs.Client != "" && entry.Client != logArgs.Client {
+				continue
+			}
+			if logArgs.Decision != "" && entry.Decision != logArgs.Decision {
+				continue
+			}
+			if domain != "" && !entryHasDomain(&entry, domain) {
+				continue
+			}
+			answer := strings.Join(entry.IPs, " ")
+			if len(entry.IPs) == 0 {
+				// AAAA, NXDOMAIN...
+				answer = strings.TrimSpace(entry.Type + " " + entry.RCode)
+			}
+			fmt.Printf("%s  %-15s  %-6s  %s  %s\n", entry.Time.Format(time.DateTime),
+				entry.Client, entry.Decision, entry.Question, answer)
+		}
+		file.Close()
+	}
+}
+
+func entryHasDomain(entry *queryLogEntry, domain string) bool {
+	match := func(name string) bool {
+		return name == domain || strings.HasSuffix(name, "."+domain)
+	}
+	if match(entry.Question) {
+		return true
+	}
+	for alias, target := range entry.CNAMEs {
+		if match(alias) || match(target) {
+			return true
+		}
+	}
+	return false
+}
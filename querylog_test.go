@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestLogQueryAfterStop(t *testing.T) {
+	savedArgs := args
+	t.Cleanup(func() {
+		args = savedArgs
+		queryLog = nil
+	})
+	args.QueryLog = filepath.Join(t.TempDir(), "query.log")
+	startQueryLog()
+
+	response := &DNSResponse{
+		question: "example.com",
+		ips:      map[string][]net.IP{"example.com": {net.ParseIP("1.2.3.4")}},
+	}
+	logQuery(net.ParseIP("192.168.1.5"), response, "proxy")
+	stopQueryLog()
+	// Late worker during shutdown
+	logQuery(net.ParseIP("192.168.1.5"), response, "direct")
+
+	content, err := os.ReadFile(args.QueryLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(content), "\n"); lines != 1 {
+		t.Errorf("query log has %d lines, want 1:\n%s", lines, content)
+	}
+}
+
+func readQueryLog(t *testing.T, path string) []queryLogEntry {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []queryLogEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+		var entry queryLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("bad line %q: %v", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestLogAnswerWithoutAddresses(t *testing.T) {
+	savedArgs := args
+	t.Cleanup(func() {
+		args = savedArgs
+		queryLog = nil
+	})
+	args.QueryLog = filepath.Join(t.TempDir(), "query.log")
+	startQueryLog()
+
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, RCode: dnsmessage.RCodeNameError})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{
+		Name:  dnsmessage.MustNewName("missing.example.com."),
+		Type:  dnsmessage.TypeAAAA,
+		Class: dnsmessage.ClassINET,
+	})
+	payload, err := builder.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, decision := processAnswer(net.ParseIP("192.168.1.5"), payload)
+	stopQueryLog()
+
+	if decision != "direct" {
+		t.Errorf("decision = %q, want direct", decision)
+	}
+	entries := readQueryLog(t, args.QueryLog)
+	want := queryLogEntry{Client: "192.168.1.5", Question: "missing.example.com", Type: "AAAA", RCode: "NXDOMAIN", Decision: "direct"}
+	if len(entries) != 1 {
+		t.Fatalf("entries = %v, want 1", entries)
+	}
+	entries[0].Time = time.Time{}
+	if !reflect.DeepEqual(entries[0], want) {
+		t.Errorf("entry = %+v, want %+v", entries[0], want)
+	}
+}
+
+func TestQueryLogRotation(t *testing.T) {
+	for _, files := range []int{0, 2} {
+		path := filepath.Join(t.TempDir(), "query.log")
+		q := &queryLogger{path: path, maxSize: 200, maxFiles: files}
+		if err := q.open(); err != nil {
+			t.Fatal(err)
+		}
+		before, _ := q.file.Stat()
+		for i := 0; i < 10; i++ {
+			q.write(&queryLogEntry{Client: "192.168.1.5", Question: "example.com", Decision: "direct"})
+		}
+		q.writer.Flush()
+		q.file.Close()
+
+		if entries := readQueryLog(t, path); len(entries) == 0 {
+			t.Errorf("files=%d: current log is empty", files)
+		}
+		// Readers like tail -f keep following the file
+		after, _ := os.Stat(path)
+		if files == 0 && !os.SameFile(before, after) {
+			t.Error("files=0: current log was replaced")
+		}
+		for i := 1; i <= files+1; i++ {
+			if exists := fileExists(rotatedLog(path, i)); exists != (i <= files) {
+				t.Errorf("files=%d: %s exists = %v", files, rotatedLog(path, i), exists)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexflint/go-arg"
+)
+
+type ReplayArgs struct {
+	Capture string `arg:"positional,required" help:"pcap or pcapng file with captured DNS traffic"`
+	Verbose bool   `arg:"-v,--verbose" help:"Also show direct answers and repeated routes"`
+}
+
+// replayCommand feeds DNS answers from a capture through processAnswer, the same
+// as daemon does. Routes go to replayRouter, nothing is changed in the system.
+func replayCommand(argv []string) {
+	var replayArgs ReplayArgs
+	parser, err := arg.NewParser(arg.Config{Program: "dnsr replay"}, &replayArgs, &args.ListArgs, &args.DecisionArgs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	parser.MustParse(argv)
+	args.Verbose = replayArgs.Verbose
+	// Routes are counted after every answer
+	args.SyncRoutes = true
+	args.RouteTimeout = time.Minute
+
+	level := slog.LevelInfo
+	if args.Verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(&consoleHandler{mu: &sync.Mutex{}, w: os.Stdout, level: level}))
+	// Blocks are decisions too, shown like new routes
+	blockLogLevel = slog.LevelInfo
+
+	loadLists()
+	loadInjectionRules()
+	loadGeoDB()
+	defer closeGeoDB()
+	replay := &replayRouter{}
+	router = replay
+
+	var packets, answers int
+	decisions := make(map[string]int)
+	err = readCapture(replayArgs.Capture, func(packet []byte) {
+		packets++
+		dnsPayload, err := extractUdpPayload(packet)
+		if err != nil {
+			return
+		}
+		_, decision := processAnswer(packetDst(packet), dnsPayload)
+		if decision != "" {
+			answers++
+			decisions[decision]++
+		}
+	})
+	if err != nil {
+		log.Printf(red("Error")+" reading %s: %v", replayArgs.Capture, err)
+		os.Exit(1)
+	}
+
+	fmt.Println("====================")
+	fmt.Printf("IPv4 packets:     %d\n", packets)
+	fmt.Printf("DNS answers:      %d\n", answers)
+	fmt.Printf("Blocked answers:  %d\n", decisions["block"])
+	fmt.Printf("Injected answers: %d\n", decisions["injected"])
+	fmt.Printf("Proxied answers:  %d\n", decisions["proxy"])
+	fmt.Printf("Direct answers:   %d\n", decisions["direct"])
+	fmt.Printf("New routes:       %d\n", replay.routes.Load())
+	if args.BlackholeBlocked {
+		fmt.Printf("Blackholes:       %d\n", replay.blackholes.Load())
+	}
+}
+
+// replayRouter accepts every route and only counts them
+type replayRouter struct {
+	routes     atomic.Int64
+	blackholes atomic.Int64
+}
+
+func (r *replayRouter) AddRoute(net.IP) error {
+	r.routes.Add(1)
+	return nil
+}
+
+func (r *replayRouter) AddBlackhole(*net.IPNet) error {
+	r.blackholes.Add(1)
+	return nil
+}
+
+func (*replayRouter) DelRoute(net.IP) error             { return nil }
+func (*replayRouter) AddNet(*net.IPNet) error           { return nil }
+func (*replayRouter) DelNet(*net.IPNet) error           { return nil }
+func (*replayRouter) DelBlackhole(*net.IPNet) error     { return nil }
+func (*replayRouter) Routes() ([]net.IP, error)         { return nil, nil }
+func (*replayRouter) Blackholes() ([]*net.IPNet, error) { return nil, nil }
+func (*replayRouter) FlushConntrack([]*net.IPNet)       {}
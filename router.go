@@ -0,0 +1,180 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// Router installs routes for proxied IPs through the tunnel interface
+type Router interface {
+	// AddRoute and DelRoute change route of a single IP. Like networks, IPs
+	// come in bulk, so callers flush conntrack with FlushConntrack once.
+	AddRoute(ip net.IP) error
+	DelRoute(ip net.IP) error
+	// AddNet routes the whole network, e.g. preset CIDR, with a single route
+	AddNet(dst *net.IPNet) error
+	DelNet(dst *net.IPNet) error
+	// AddBlackhole drops all traffic to dst, regardless of interface
+	AddBlackhole(dst *net.IPNet) error
+	DelBlackhole(dst *net.IPNet) error
+	// Blackholes lists blackhole routes added by dnsr, e.g. by previous run
+	Blackholes() ([]*net.IPNet, error)
+	// FlushConntrack deletes flows to any of dsts with a single table dump
+	FlushConntrack(dsts []*net.IPNet)
+	// Routes lists destinations currently routed through the interface
+	Routes() ([]net.IP, error)
+}
+
+type netlinkRouter struct {
+	link netlink.Link
+}
+
+func newNetlinkRouter(link netlink.Link) *netlinkRouter {
+	return &netlinkRouter{link: link}
+}
+
+func (r *netlinkRouter) route(dst *net.IPNet) *netlink.Route {
+	return &netlink.Route{
+		LinkIndex: r.link.Attrs().Index,
+		Scope:     netlink.SCOPE_UNIVERSE,
+		Dst:       dst,
+		Table:     0,
+	}
+}
+
+func (r *netlinkRouter) AddRoute(ip net.IP) error {
+	return nl.RouteAdd(r.route(singleHostRoute(ip)))
+}
+
+func (r *netlinkRouter) DelRoute(ip net.IP) error {
+	return nl.RouteDel(r.route(singleHostRoute(ip)))
+}
+
+func (r *netlinkRouter) AddNet(dst *net.IPNet) error {
+	return nl.RouteAdd(r.route(dst))
+}
+
+func (r *netlinkRouter) DelNet(dst *net.IPNet) error {
+	return nl.RouteDel(r.route(dst))
+}
+
+// Marks blackhole routes of dnsr, they aren't bound to interface like routes
+// to the tunnel and are found by protocol after restart
+const blackholeProtocol = netlink.RouteProtocol(234)
+
+func (r *netlinkRouter) blackhole(dst *net.IPNet) *netlink.Route {
+	return &netlink.Route{
+		Dst:      dst,
+		Type:     unix.RTN_BLACKHOLE,
+		Protocol: blackholeProtocol,
+		Table:    0,
+	}
+}
+
+func (r *netlinkRouter) Blackholes() ([]*net.IPNet, error) {
+	routes, err := nl.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		Type:     unix.RTN_BLACKHOLE,
+		Protocol: blackholeProtocol,
+	}, netlink.RT_FILTER_TYPE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return nil, err
+	}
+	var result []*net.IPNet
+	for _, route := range routes {
+		if route.Dst != nil {
+			result = append(result, route.Dst)
+		}
+	}
+	return result, nil
+}
+
+func (r *netlinkRouter) AddBlackhole(dst *net.IPNet) error {
+	return nl.RouteAdd(r.blackhole(dst))
+}
+
+func (r *netlinkRouter) DelBlackhole(dst *net.IPNet) error {
+	return nl.RouteDel(r.blackhole(dst))
+}
+
+// FlushConntrack deletes flows to dsts, otherwise established connections and
+// retries keep the old path and masquerade state until they time out
+func (r *netlinkRouter) FlushConntrack(dsts []*net.IPNet) {
+	var filter rangeFilter
+	for _, dst := range dsts {
+		if dst.IP.To4() != nil {
+			filter = append(filter, netToRange(dst))
+		}
+	}
+	if len(filter) == 0 {
+		return
+	}
+	filter = mergeRanges(filter)
+	deleted, err := nl.ConntrackDeleteFilters(netlink.ConntrackTable, netlink.FAMILY_V4, filter)
+	if err != nil {
+		slog.Warn("Can't flush conntrack entries", "dst", dsts, "err", err)
+		return
+	}
+	if deleted > 0 {
+		slog.Debug("Conntrack entries flushed", "networks", len(dsts), "count", deleted)
+	}
+}
+
+// rangeFilter matches flows to sorted non-overlapping ranges, thousands of preset
+// networks are checked with binary search instead of a filter per network
+type rangeFilter []ipRange
+
+func (f rangeFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	ip := flow.Forward.DstIP.To4()
+	if ip == nil {
+		return false
+	}
+	v := ipToUint(ip)
+	i := sort.Search(len(f), func(i int) bool { return f[i].last >= v })
+	return i < len(f) && f[i].first <= v
+}
+
+func (r *netlinkRouter) Routes() ([]net.IP, error) {
+	routes, err := nl.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
+		LinkIndex: r.link.Attrs().Index,
+		Table:     0,
+	}, netlink.RT_FILTER_OIF)
+	if err != nil {
+		return nil, err
+	}
+	var result []net.IP
+	for _, route := range routes {
+		// Networks are not created for IPs from DNS answers
+		if route.Dst == nil {
+			continue
+		}
+		if ones, bits := route.Dst.Mask.Size(); ones == bits {
+			result = append(result, route.Dst.IP)
+		}
+	}
+	return result, nil
+}
+
+func singleHostRoutes(ips []net.IP) []*net.IPNet {
+	result := make([]*net.IPNet, 0, len(ips))
+	for _, ip := range ips {
+		result = append(result, singleHostRoute(ip))
+	}
+	return result
+}
+
+func singleHostRoute(ip net.IP) *net.IPNet {
+	if ip.To4() != nil {
+		return &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(32, 32),
+		}
+	}
+	return &net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(128, 128),
+	}
+}
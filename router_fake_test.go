@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeRouter keeps routes in memory, like kernel table of a single interface.
+// It lets routing logic run without root and without touching the system.
+// Errors wrap the same errno as netlink does.
+type fakeRouter struct {
+	mu     sync.Mutex
+	routes map[string]net.IP
+	nets   map[string]*net.IPNet
+	// Blackhole routes
+	blackholes map[string]*net.IPNet
+	// Number of add/del calls, including failed ones
+	added   int
+	deleted int
+	// Number of FlushConntrack calls and destinations flushed by them
+	flushes int
+	flushed int
+}
+
+func newFakeRouter(preset ...net.IP) *fakeRouter {
+	r := &fakeRouter{
+		routes:     make(map[string]net.IP),
+		nets:       make(map[string]*net.IPNet),
+		blackholes: make(map[string]*net.IPNet),
+	}
+	for _, ip := range preset {
+		r.routes[ip.String()] = ip
+	}
+	return r
+}
+
+func (r *fakeRouter) AddRoute(ip net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.added++
+	if _, exists := r.routes[ip.String()]; exists {
+		return fmt.Errorf("route to %s: %w", ip, unix.EEXIST)
+	}
+	r.routes[ip.String()] = ip
+	return nil
+}
+
+func (r *fakeRouter) DelRoute(ip net.IP) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deleted++
+	if _, exists := r.routes[ip.String()]; !exists {
+		return fmt.Errorf("route to %s: %w", ip, unix.ESRCH)
+	}
+	delete(r.routes, ip.String())
+	return nil
+}
+
+func (r *fakeRouter) AddNet(dst *net.IPNet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.added++
+	if _, exists := r.nets[dst.String()]; exists {
+		return fmt.Errorf("route to %s: %w", dst, unix.EEXIST)
+	}
+	r.nets[dst.String()] = dst
+	return nil
+}
+
+func (r *fakeRouter) DelNet(dst *net.IPNet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deleted++
+	if _, exists := r.nets[dst.String()]; !exists {
+		return fmt.Errorf("route to %s: %w", dst, unix.ESRCH)
+	}
+	delete(r.nets, dst.String())
+	return nil
+}
+
+func (r *fakeRouter) AddBlackhole(dst *net.IPNet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.added++
+	if _, exists := r.blackholes[dst.String()]; exists {
+		return fmt.Errorf("blackhole %s: %w", dst, unix.EEXIST)
+	}
+	r.blackholes[dst.String()] = dst
+	return nil
+}
+
+func (r *fakeRouter) DelBlackhole(dst *net.IPNet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deleted++
+	if _, exists := r.blackholes[dst.String()]; !exists {
+		return fmt.Errorf("blackhole %s: %w", dst, unix.ESRCH)
+	}
+	delete(r.blackholes, dst.String())
+	return nil
+}
+
+func (r *fakeRouter) Blackholes() ([]*net.IPNet, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []*net.IPNet
+	for _, dst := range r.blackholes {
+		result = append(result, dst)
+	}
+	return result, nil
+}
+
+func (r *fakeRouter) FlushConntrack(dsts []*net.IPNet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushes++
+	r.flushed += len(dsts)
+}
+
+func (r *fakeRouter) Routes() ([]net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	result := make([]net.IP, 0, len(r.routes))
+	for _, ip := range r.routes {
+		result = append(result, ip)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].String() < result[j].String()
+	})
+	return result, nil
+}
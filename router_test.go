@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestRangeFilter(t *testing.T) {
+	var filter rangeFilter
+	for _, cidr := range []string{"10.0.0.0/24", "192.168.1.5/32", "10.0.1.0/24", "172.16.0.0/12"} {
+		_, dst, _ := net.ParseCIDR(cidr)
+		filter = append(filter, netToRange(dst))
+	}
+	filter = mergeRanges(filter)
+
+	tests := []struct {
+		dst  string
+		want bool
+	}{
+		{"10.0.0.1", true},
+		{"10.0.1.255", true},
+		{"10.0.2.0", false},
+		{"192.168.1.5", true},
+		{"192.168.1.6", false},
+		{"172.31.255.255", true},
+		{"9.255.255.255", false},
+		{"255.255.255.255", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		flow := &netlink.ConntrackFlow{}
+		flow.Forward.DstIP = net.ParseIP(tt.dst)
+		if got := filter.MatchConntrackFlow(flow); got != tt.want {
+			t.Errorf("match %s = %v, want %v", tt.dst, got, tt.want)
+		}
+	}
+}
@@ -1,152 +1,272 @@
 package main
 
 import (
-	"bufio"
-	"fmt"
+	"errors"
 	"log"
+	"log/slog"
 	"net"
-	"os"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 var (
-	link netlink.Link
+	link   netlink.Link
+	router Router
+	// Preset networks, routed as a whole. Split when endpoint moves into one.
+	presetNets   []*net.IPNet
+	presetNetsMu sync.Mutex
+
+	// IP -> closed when its route is installed, with --sync-routes
+	pendingRoutes   = make(map[string]chan struct{})
+	pendingRoutesMu sync.Mutex
 )
 
 func setupRouting() {
 	// Find collisions
-	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Table:     0,
-	}, netlink.RT_FILTER_OIF)
+	routes, err := router.Routes()
 	if err != nil {
 		log.Fatalf(red("Error:")+" can't read netlink.RouteList: %v", err)
 		return
 	}
 
-	for _, route := range routes {
-		if route.Dst != nil {
-			proxyIPset.Add(route.Dst.IP)
-		}
+	for _, ip := range routes {
+		proxyIPset.Add(ip)
+		proxyIPset.SetOrigin(ip, "existing")
 	}
 	if len(proxyIPset.set) > 0 {
 		log.Printf(yellow("WARNING! ")+"found %d collisions in routes table! Will be treated as own.", len(proxyIPset.set))
 	}
 
 	// Load user preset
+	ips, ranges := readPresets(args.PresetIPs)
+	// Route to WireGuard endpoint through the tunnel would break the tunnel
+	wgEndpointIPs.Each(func(ip string, _ RouteInfo) {
+		ranges = excludeIP(ranges, net.ParseIP(ip))
+	})
+	var added []*net.IPNet
+	for _, r := range ranges {
+		for _, dst := range r.nets() {
+			if addPresetNet(dst) {
+				added = append(added, dst)
+			}
+		}
+	}
+	var hosts []net.IP
 	count := 0
-	for _, source := range strings.Split(args.PresetIPs, ";") {
-		source = strings.TrimSpace(source)
-		if source == "" {
+	for _, preset := range ips {
+		ip := preset.ip
+		if wgEndpointIPs.Exists(ip) {
+			log.Printf(yellow("Skip WireGuard endpoint in %s: ")+"%s", preset.source, ip)
 			continue
 		}
-		file, err := os.Open(source)
-		if err != nil {
-			log.Fatalf(red("Error")+" opening file %s: %v", source, err)
+		if presetNetsContain(ip) {
 			continue
 		}
-		defer file.Close()
-
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			// Remove comment
-			if idx := strings.Index(line, "#"); idx != -1 {
-				line = line[:idx]
-			}
-			line = strings.TrimSpace(line)
-			if line == "" {
-				continue
-			}
-			// Parse IP
-			ip := net.ParseIP(line)
-			if ip == nil {
-				log.Printf(yellow("Can't parse line in %s: ")+"%s", source, line)
-				continue
-			}
-			if proxyIPset.Add(ip) && addRoute(ip) {
-				count++
-			} else {
-				log.Printf(yellow("  %s"), ip.String())
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			log.Fatalf(red("Error")+" reading file %s: %v", source, err)
+		if proxyIPset.Add(ip) && addRoute(ip) {
+			proxyIPset.SetOrigin(ip, "preset "+preset.source)
+			hosts = append(hosts, ip)
+			count++
+		} else {
+			log.Printf(yellow("  %s"), ip.String())
 		}
 	}
+	// Single dump of conntrack table for all networks and IPs
+	router.FlushConntrack(append(added, singleHostRoutes(hosts)...))
 
 	if args.PresetIPs != "" {
-		log.Printf("Routing %d preset IP addresses", count)
+		log.Printf("Routing %d preset IP addresses, %d networks", count, len(added))
 	}
 }
 
-func cleanupRouting() {
-	if !args.Persistent {
-		routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{
-			LinkIndex: link.Attrs().Index,
-			Table:     0,
-		}, netlink.RT_FILTER_OIF)
-		if err != nil {
-			log.Fatalf(red("Error:")+" can't read netlink.RouteList: %v", err)
-			return
-		}
+// addPresetNet routes network, route left by --persistent run is fine
+func addPresetNet(dst *net.IPNet) bool {
+	err := router.AddNet(dst)
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		log.Printf(red("Error:")+" adding route to %s: %v", dst, err)
+		return false
+	}
+	presetNetsMu.Lock()
+	presetNets = append(presetNets, dst)
+	presetNetsMu.Unlock()
+	return true
+}
+
+func presetNetsContain(ip net.IP) bool {
+	return presetNetFor(ip) != nil
+}
+
+// presetNetFor returns preset network routing ip, nil if none
+func presetNetFor(ip net.IP) *net.IPNet {
+	presetNetsMu.Lock()
+	defer presetNetsMu.Unlock()
+	return netContaining(presetNets, ip)
+}
 
-		for ip := range proxyIPset.set {
-			delRoute(net.ParseIP(ip))
+func netContaining(nets []*net.IPNet, ip net.IP) *net.IPNet {
+	for _, dst := range nets {
+		if dst.Contains(ip) {
+			return dst
 		}
+	}
+	return nil
+}
+
+// excludeFromPresetNets splits preset networks around ip, e.g. WireGuard endpoint
+// which moved into one of them
+func excludeFromPresetNets(ip net.IP) {
+	presetNetsMu.Lock()
+	defer presetNetsMu.Unlock()
+	presetNets = splitNets(presetNets, ip, router.AddNet, router.DelNet)
+}
 
-		for _, route := range routes {
-			if route.Dst != nil {
-				proxyIPset.Add(route.Dst.IP)
+// splitNets replaces networks containing ip with their parts without it. Parts
+// are added before the network is deleted, so the rest of its addresses don't
+// lose the route meanwhile.
+func splitNets(nets []*net.IPNet, ip net.IP, add, del func(*net.IPNet) error) []*net.IPNet {
+	var kept []*net.IPNet
+	for _, dst := range nets {
+		if !dst.Contains(ip) {
+			kept = append(kept, dst)
+			continue
+		}
+		for _, r := range excludeIP([]ipRange{netToRange(dst)}, ip) {
+			for _, part := range r.nets() {
+				err := add(part)
+				if err != nil && !errors.Is(err, unix.EEXIST) {
+					log.Printf(red("Error:")+" adding route to %s: %v", part, err)
+					continue
+				}
+				kept = append(kept, part)
 			}
 		}
-		log.Println(green("Routing cleanup completed"))
-	} else {
-		if len(proxyIPset.set) > 0 {
-			fmt.Printf(yellow("There are %d entries in the routing table, there will be no cleaning.\n"), len(proxyIPset.set))
+		if err := del(dst); err != nil {
+			log.Printf(red("Error:")+" deleting route to %s: %v", dst, err)
 		}
+		log.Printf(yellow("Network %s split around WireGuard endpoint %s"), dst, ip)
 	}
+	return kept
 }
 
-func singleHostRoute(ip net.IP) *net.IPNet {
-	if ip.To4() != nil {
-		return &net.IPNet{
-			IP:   ip,
-			Mask: net.CIDRMask(32, 32),
+func cleanupRouting() {
+	routeInstalls.Wait()
+	if !args.Persistent {
+		presetNetsMu.Lock()
+		defer presetNetsMu.Unlock()
+		removed := 0
+		var removedNets []*net.IPNet
+		for _, dst := range presetNets {
+			if err := router.DelNet(dst); err != nil {
+				log.Printf(red("Error:")+" deleting route to %s: %v", dst, err)
+				continue
+			}
+			removedNets = append(removedNets, dst)
+			removed++
+		}
+
+		var ips []net.IP
+		proxyIPset.Each(func(ip string, _ RouteInfo) {
+			ips = append(ips, net.ParseIP(ip))
+		})
+		for _, ip := range ips {
+			if delRoute(ip) {
+				removedNets = append(removedNets, singleHostRoute(ip))
+				removed++
+			}
+		}
+		router.FlushConntrack(removedNets)
+		slog.Info(green("Routing cleanup completed"), "removed", removed)
+	} else {
+		if count := proxyIPset.Len(); count > 0 {
+			log.Printf(yellow("There are %d entries in the routing table, there will be no cleaning."), count)
 		}
-	}
-	return &net.IPNet{
-		IP:   ip,
-		Mask: net.CIDRMask(128, 128),
 	}
 }
 
 func addRoute(ip net.IP) bool {
-	newRoute := &netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Scope:     netlink.SCOPE_UNIVERSE,
-		Dst:       singleHostRoute(ip),
-		Table:     0,
-	}
-	err := netlink.RouteAdd(newRoute)
-	if err != nil {
+	if err := router.AddRoute(ip); err != nil {
 		log.Printf(red("Error:")+" adding route: %v", err)
 		return false
 	}
 	return true
 }
 
-func delRoute(ip net.IP) {
-	newRoute := &netlink.Route{
-		LinkIndex: link.Attrs().Index,
-		Scope:     netlink.SCOPE_UNIVERSE,
-		Dst:       singleHostRoute(ip),
-		Table:     0,
+// claimRoute adds IP of answer to proxyIPset. With --sync-routes it also returns
+// channel closed when the route is installed, by this answer or by another one
+// processed on other worker at the same time. Nil if route is already there.
+func claimRoute(ip net.IP) (bool, chan struct{}) {
+	pendingRoutesMu.Lock()
+	defer pendingRoutesMu.Unlock()
+	added := proxyIPset.Add(ip)
+	if !args.SyncRoutes {
+		return added, nil
 	}
-	err := netlink.RouteDel(newRoute)
-	if err != nil {
+	key := ip.String()
+	if added {
+		pendingRoutes[key] = make(chan struct{})
+	}
+	return added, pendingRoutes[key]
+}
+
+// Background installs of installRoutes, cleanup waits for them so nothing is
+// added after it
+var routeInstalls sync.WaitGroup
+
+// installRoutes adds routes for new IPs of one answer with add, in background,
+// and flushes conntrack for them at once. With --sync-routes answer is held
+// until waits are closed, i.e. routes for all its IPs are in place, so client
+// doesn't connect directly first.
+func installRoutes(ips []net.IP, add func(net.IP) bool, waits []chan struct{}) {
+	if len(ips) > 0 {
+		routeInstalls.Add(1)
+		go func() {
+			defer routeInstalls.Done()
+			var added []net.IP
+			for _, ip := range ips {
+				if add(ip) {
+					added = append(added, ip)
+				}
+			}
+			if len(added) > 0 {
+				router.FlushConntrack(singleHostRoutes(added))
+			}
+		}()
+	}
+	if !args.SyncRoutes || len(waits) == 0 {
+		return
+	}
+	timeout := time.After(args.RouteTimeout)
+	for _, done := range waits {
+		select {
+		case <-done:
+		case <-timeout:
+			slog.Warn("Route is not installed in time, answer accepted", "ip", ips, "timeout", args.RouteTimeout)
+			return
+		}
+	}
+}
+
+// addProxyRoute installs route for IP claimed by claimRoute and releases
+// answers waiting for it
+func addProxyRoute(ip net.IP) bool {
+	// Blackhole of the same address would make route fail
+	releaseBlackhole(ip)
+	added := addRoute(ip)
+	pendingRoutesMu.Lock()
+	if done, exists := pendingRoutes[ip.String()]; exists {
+		close(done)
+		delete(pendingRoutes, ip.String())
+	}
+	pendingRoutesMu.Unlock()
+	return added
+}
+
+func delRoute(ip net.IP) bool {
+	if err := router.DelRoute(ip); err != nil {
 		log.Printf(red("Error:")+" deleting route: %v", err)
+		return false
 	}
+	return true
 }
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// withFakeRouter resets routing state and restores it after the test
+func withFakeRouter(t *testing.T, existing ...net.IP) *fakeRouter {
+	t.Helper()
+	fake := newFakeRouter(existing...)
+	savedRouter, savedArgs := router, args
+	savedProxy, savedNets, savedEndpoints := proxyIPset, presetNets, wgEndpointIPs
+	router = fake
+	proxyIPset = NewIPv4Set(0)
+	presetNets = nil
+	wgEndpointIPs = NewIPv4Set(64)
+	t.Cleanup(func() {
+		router, args = savedRouter, savedArgs
+		proxyIPset, presetNets, wgEndpointIPs = savedProxy, savedNets, savedEndpoints
+	})
+	return fake
+}
+
+func writePresets(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "preset.txt")
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func (r *fakeRouter) netList() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var result []string
+	for dst := range r.nets {
+		result = append(result, dst)
+	}
+	return result
+}
+
+func TestSetupRoutingCollisions(t *testing.T) {
+	existing := net.ParseIP("1.2.3.4").To4()
+	withFakeRouter(t, existing)
+
+	setupRouting()
+
+	info, ok := proxyIPset.Info(existing)
+	if !ok {
+		t.Fatal("existing route is not tracked")
+	}
+	if info.Origin != "existing" {
+		t.Errorf("origin = %q, want existing", info.Origin)
+	}
+}
+
+func TestSetupRoutingPresets(t *testing.T) {
+	fake := withFakeRouter(t)
+	args.PresetIPs = writePresets(t, "8.8.8.8\n10.0.0.0/30 # network\n10.0.0.2\n1.1.1.1\n")
+	wgEndpointIPs.Add(net.ParseIP("1.1.1.1"))
+
+	setupRouting()
+
+	routes, _ := fake.Routes()
+	if len(routes) != 1 || !routes[0].Equal(net.ParseIP("8.8.8.8")) {
+		t.Errorf("routes = %v, want [8.8.8.8]", routes)
+	}
+	if nets, want := fake.netList(), []string{"10.0.0.0/30"}; !reflect.DeepEqual(nets, want) {
+		t.Errorf("nets = %v, want %v", nets, want)
+	}
+	info, _ := proxyIPset.Info(net.ParseIP("8.8.8.8"))
+	if info.Origin != "preset "+args.PresetIPs {
+		t.Errorf("origin = %q, want preset", info.Origin)
+	}
+}
+
+func TestSetupRoutingSplitsNetworkAroundEndpoint(t *testing.T) {
+	fake := withFakeRouter(t)
+	args.PresetIPs = writePresets(t, "10.0.0.0/30\n")
+	wgEndpointIPs.Add(net.ParseIP("10.0.0.1"))
+
+	setupRouting()
+
+	for _, dst := range fake.netList() {
+		_, ipNet, _ := net.ParseCIDR(dst)
+		if ipNet.Contains(net.ParseIP("10.0.0.1")) {
+			t.Errorf("network %s contains WireGuard endpoint", dst)
+		}
+	}
+	if !presetNetsContain(net.ParseIP("10.0.0.3")) {
+		t.Error("rest of the network is not routed")
+	}
+}
+
+func TestPresetNetsFlushConntrackOnce(t *testing.T) {
+	fake := withFakeRouter(t)
+	args.PresetIPs = writePresets(t, "10.0.0.0/24\n10.1.0.0/24\n10.2.0.0/24\n")
+
+	setupRouting()
+	if fake.flushes != 1 || len(presetNets) != 3 {
+		t.Errorf("conntrack flushed %d times for %d networks, want once", fake.flushes, len(presetNets))
+	}
+	cleanupRouting()
+	if fake.flushes != 2 {
+		t.Errorf("conntrack flushed %d times on cleanup, want once", fake.flushes-1)
+	}
+}
+
+func TestCleanupRoutingManyAnswers(t *testing.T) {
+	fake := withFakeRouter(t)
+
+	// More addresses than the set used to hold before evicting
+	for i := 0; i < 1500; i++ {
+		ip := net.IPv4(10, 1, byte(i>>8), byte(i))
+		if added, _ := claimRoute(ip); !added {
+			t.Fatalf("%s is not claimed", ip)
+		}
+		installRoutes([]net.IP{ip}, addProxyRoute, nil)
+	}
+	routeInstalls.Wait()
+	if routes, _ := fake.Routes(); len(routes) != 1500 {
+		t.Fatalf("%d routes installed, want 1500", len(routes))
+	}
+
+	cleanupRouting()
+	if routes, _ := fake.Routes(); len(routes) != 0 {
+		t.Errorf("%d routes left after cleanup", len(routes))
+	}
+}
+
+func TestRoutesFlushConntrackOncePerBatch(t *testing.T) {
+	fake := withFakeRouter(t)
+	args.PresetIPs = writePresets(t, "8.8.8.8\n9.9.9.9\n10.0.0.0/24\n")
+
+	setupRouting()
+	if fake.flushes != 1 || fake.flushed != 3 {
+		t.Errorf("setup: %d flushes of %d destinations, want 1 of 3", fake.flushes, fake.flushed)
+	}
+
+	var ips []net.IP
+	for _, s := range []string{"1.1.1.1", "1.1.1.2", "1.1.1.3"} {
+		ip := net.ParseIP(s).To4()
+		proxyIPset.Add(ip)
+		ips = append(ips, ip)
+	}
+	installRoutes(ips, addProxyRoute, nil)
+	routeInstalls.Wait()
+	if fake.flushes != 2 || fake.flushed != 6 {
+		t.Errorf("answer: %d flushes of %d destinations, want 2 of 6", fake.flushes, fake.flushed)
+	}
+
+	cleanupRouting()
+	if fake.flushes != 3 || fake.flushed != 12 {
+		t.Errorf("cleanup: %d flushes of %d destinations, want 3 of 12", fake.flushes, fake.flushed)
+	}
+}
+
+func TestCleanupRouting(t *testing.T) {
+	fake := withFakeRouter(t, net.ParseIP("1.2.3.4").To4())
+	args.PresetIPs = writePresets(t, "8.8.8.8\n10.0.0.0/24\n")
+	setupRouting()
+	proxyIPset.Add(net.ParseIP("5.6.7.8"))
+	addRoute(net.ParseIP("5.6.7.8"))
+
+	cleanupRouting()
+
+	if routes, _ := fake.Routes(); len(routes) != 0 {
+		t.Errorf("routes left after cleanup: %v", routes)
+	}
+	if nets := fake.netList(); len(nets) != 0 {
+		t.Errorf("networks left after cleanup: %v", nets)
+	}
+}
+
+func TestPersistentRouting(t *testing.T) {
+	fake := withFakeRouter(t)
+	args.PresetIPs = writePresets(t, "8.8.8.8\n10.0.0.0/24\n")
+	args.Persistent = true
+	setupRouting()
+
+	cleanupRouting()
+	if routes, _ := fake.Routes(); len(routes) != 1 {
+		t.Errorf("routes = %v, want preset route kept", routes)
+	}
+	if nets := fake.netList(); len(nets) != 1 {
+		t.Errorf("nets = %v, want preset network kept", nets)
+	}
+
+	// Next run finds routes left by this one
+	proxyIPset = NewIPv4Set(0)
+	presetNets = nil
+	setupRouting()
+	info, _ := proxyIPset.Info(net.ParseIP("8.8.8.8"))
+	if info.Origin != "existing" {
+		t.Errorf("origin of left route = %q, want existing", info.Origin)
+	}
+	if len(presetNets) != 1 {
+		t.Errorf("left preset network is not tracked: %v", presetNets)
+	}
+
+	args.Persistent = false
+	cleanupRouting()
+	if routes, _ := fake.Routes(); len(routes) != 0 {
+		t.Errorf("routes left after cleanup: %v", routes)
+	}
+	if nets := fake.netList(); len(nets) != 0 {
+		t.Errorf("networks left after cleanup: %v", nets)
+	}
+}
+
+// slowRouter holds AddRoute until released
+type slowRouter struct {
+	*fakeRouter
+	release chan struct{}
+}
+
+func (r *slowRouter) AddRoute(ip net.IP) error {
+	<-r.release
+	return r.fakeRouter.AddRoute(ip)
+}
+
+func TestSyncRoutesWaitForPendingRoute(t *testing.T) {
+	fake := withFakeRouter(t)
+	slow := &slowRouter{fake, make(chan struct{})}
+	router = slow
+	args.SyncRoutes = true
+	args.RouteTimeout = 5 * time.Second
+	ip := net.ParseIP("1.2.3.4")
+
+	answer := func() chan struct{} {
+		var newIPs []net.IP
+		added, wait := claimRoute(ip)
+		if added {
+			newIPs = append(newIPs, ip)
+		}
+		done := make(chan struct{})
+		go func() {
+			installRoutes(newIPs, addProxyRoute, []chan struct{}{wait})
+			close(done)
+		}()
+		return done
+	}
+	first := answer()
+	// Same IP in answer processed by another worker
+	second := answer()
+
+	select {
+	case <-first:
+		t.Fatal("first answer accepted before route is installed")
+	case <-second:
+		t.Fatal("second answer accepted before route is installed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(slow.release)
+	<-first
+	<-second
+	if routes, _ := fake.Routes(); len(routes) != 1 {
+		t.Errorf("routes = %v, want [1.2.3.4]", routes)
+	}
+
+	// Installed route doesn't hold answers
+	if _, wait := claimRoute(ip); wait != nil {
+		t.Error("answer waits for installed route")
+	}
+}
+
+func TestEndpointMovesIntoPresetNet(t *testing.T) {
+	fake := withFakeRouter(t)
+	args.PresetIPs = writePresets(t, "10.0.0.0/24\n")
+	setupRouting()
+
+	endpoint := net.ParseIP("10.0.0.77")
+	protectEndpoint(endpoint)
+
+	if presetNetsContain(endpoint) {
+		t.Error("preset networks still contain new endpoint")
+	}
+	for _, ip := range []string{"10.0.0.0", "10.0.0.76", "10.0.0.78", "10.0.0.255"} {
+		if !presetNetsContain(net.ParseIP(ip)) {
+			t.Errorf("%s is not routed after split", ip)
+		}
+	}
+	routed := 0
+	for _, dst := range fake.netList() {
+		_, ipNet, _ := net.ParseCIDR(dst)
+		if ipNet.Contains(endpoint) {
+			t.Errorf("route %s contains new endpoint", dst)
+		}
+		ones, _ := ipNet.Mask.Size()
+		routed += 1 << (32 - ones)
+	}
+	if routed != 255 {
+		t.Errorf("%d addresses routed, want 255", routed)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// Passive mode for systems without NFQUEUE: DNS answers are copied from an
+// AF_PACKET socket. Packets can't be held or dropped, so routes are installed
+// in parallel with the client receiving the answer and blocking isn't possible.
+
+var (
+	sniffFd      = -1
+	sniffStopped atomic.Bool
+)
+
+// Kernel side filter: IPv4, UDP, not a fragment, source port 53. Packets of
+// SOCK_DGRAM socket start with the IP header.
+var sniffFilter = []bpf.Instruction{
+	bpf.LoadAbsolute{Off: 9, Size: 1},
+	bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: unix.IPPROTO_UDP, SkipTrue: 6},
+	bpf.LoadAbsolute{Off: 6, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+	bpf.LoadMemShift{Off: 0},
+	bpf.LoadIndirect{Off: 0, Size: 2},
+	bpf.JumpIf{Cond: bpf.JumpEqual, Val: 53, SkipFalse: 1},
+	bpf.RetConstant{Val: 0xFFFF},
+	bpf.RetConstant{Val: 0},
+}
+
+func startSniffer() {
+	log.Print(yellow("Passive mode: DNS answers are sniffed, not intercepted."))
+	log.Print(yellow("Blocking and dropping of injected answers are not available."))
+
+	if err := inNetns(openSniffSocket); err != nil {
+		log.Fatalf(red("Error:")+" opening packet socket: %v", err)
+	}
+	go sniff()
+	log.Print(green("Sniffing DNS answers on all interfaces"))
+}
+
+func openSniffSocket() error {
+	raw, err := bpf.Assemble(sniffFilter)
+	if err != nil {
+		return err
+	}
+	filter := make([]unix.SockFilter, len(raw))
+	for i, ins := range raw {
+		filter[i] = unix.SockFilter{Code: ins.Op, Jt: ins.Jt, Jf: ins.Jf, K: ins.K}
+	}
+
+	// Protocol 0 receives nothing until bind, so no packet passes unfiltered
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("attaching filter: %v", err)
+	}
+	// Reader checks for stop once a second
+	timeout := unix.NsecToTimeval(time.Second.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &timeout); err != nil {
+		unix.Close(fd)
+		return err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_IP)}); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("binding: %v", err)
+	}
+	sniffFd = fd
+	return nil
+}
+
+func sniff() {
+	buf := make([]byte, 0xFFFF)
+	seen := make(map[uint64]time.Time)
+	lastSweep := time.Now()
+	for !sniffStopped.Load() {
+		n, _, err := unix.Recvfrom(sniffFd, buf, 0)
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			if !sniffStopped.Load() {
+				slog.Error("Can't read packet socket", "err", err)
+			}
+			return
+		}
+
+		// Forwarded answer is seen twice: coming in and going out
+		key := packetKey(buf[:n])
+		if at, exists := seen[key]; exists && time.Since(at) < time.Second {
+			continue
+		}
+		seen[key] = time.Now()
+		if time.Since(lastSweep) > 10*time.Second {
+			for key, at := range seen {
+				if time.Since(at) > time.Second {
+					delete(seen, key)
+				}
+			}
+			lastSweep = time.Now()
+		}
+
+		processPacket(buf[:n])
+	}
+}
+
+// Destination and UDP payload of the packet; IP header differs between copies
+func packetKey(packet []byte) uint64 {
+	hash := fnv.New64a()
+	hash.Write(packetDst(packet))
+	if payload, err := extractUdpPayload(packet); err == nil {
+		hash.Write(payload)
+	}
+	return hash.Sum64()
+}
+
+func stopSniffer() {
+	if sniffFd < 0 {
+		return
+	}
+	sniffStopped.Store(true)
+	unix.Close(sniffFd)
+}
+
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
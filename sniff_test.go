@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// ipv4Packet builds IPv4 header without options and 8 bytes of transport header
+func ipv4Packet(proto uint8, fragment uint16, sport uint16) []byte {
+	packet := make([]byte, 28)
+	packet[0] = 0x45
+	binary.BigEndian.PutUint16(packet[2:4], uint16(len(packet)))
+	binary.BigEndian.PutUint16(packet[6:8], fragment)
+	packet[9] = proto
+	binary.BigEndian.PutUint16(packet[20:22], sport)
+	return packet
+}
+
+func TestSniffFilter(t *testing.T) {
+	vm, err := bpf.NewVM(sniffFilter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		packet []byte
+		want   int
+	}{
+		{"UDP/53", ipv4Packet(unix.IPPROTO_UDP, 0, 53), 0xFFFF},
+		{"UDP/53 don't fragment", ipv4Packet(unix.IPPROTO_UDP, 0x4000, 53), 0xFFFF},
+		{"UDP/80", ipv4Packet(unix.IPPROTO_UDP, 0, 80), 0},
+		{"TCP/53", ipv4Packet(unix.IPPROTO_TCP, 0, 53), 0},
+		{"TCP/443", ipv4Packet(unix.IPPROTO_TCP, 0, 443), 0},
+		{"fragment", ipv4Packet(unix.IPPROTO_UDP, 0x00b9, 53), 0},
+	}
+	for _, tt := range tests {
+		got, err := vm.Run(tt.packet)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: filter returned %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+#!/usr/bin/env bash
+#
+# End-to-end test: dnsr in its own network namespace between a client and an
+# upstream with stub DNS server. Needs root, run from repository root:
+#
+#   sudo test/e2e.sh
+#
+#  client (10.99.1.2) --- (10.99.1.1) router (10.99.2.1) --- (10.99.2.2) upstream
+#                                       t0 (10.99.3.1) ----- t1 (10.99.3.2)
+#
+# Upstream runs stub DNS. Router runs dnsr with `--interface t0`, veth pair
+# t0/t1 stands in for the tunnel. One run starts dnsr outside and enters
+# router namespace with --netns.
+
+set -euo pipefail
+
+CLIENT=dnsr-e2e-client
+ROUTER=dnsr-e2e-router
+UPSTREAM=dnsr-e2e-upstream
+DNS=10.99.2.2:53
+
+PROXIED_IP=10.99.4.10
+BLOCKED_IP=10.99.4.20
+DIRECT_IP=10.99.4.30
+DNSTAP_IP=10.99.4.40
+
+WORK=$(mktemp -d)
+DNSR_PID=
+STUB_PID=
+FAILED=0
+
+cleanup() {
+	[ -n "$DNSR_PID" ] && kill "$DNSR_PID" 2>/dev/null && wait "$DNSR_PID" 2>/dev/null
+	[ -n "$STUB_PID" ] && kill "$STUB_PID" 2>/dev/null
+	for ns in $CLIENT $ROUTER $UPSTREAM; do
+		ip netns del $ns 2>/dev/null || true
+	done
+	rm -rf "$WORK"
+}
+trap cleanup EXIT
+
+pass() { echo "PASS: $*"; }
+fail() { echo "FAIL: $*"; FAILED=1; }
+
+in_client() { ip netns exec $CLIENT "$@"; }
+in_router() { ip netns exec $ROUTER "$@"; }
+in_upstream() { ip netns exec $UPSTREAM "$@"; }
+
+# Rules installed by dnsr, through whichever firewall binary is present
+queue_rules() {
+	in_router nft list ruleset 2>/dev/null | grep -E 'queue' || true
+	in_router iptables-save 2>/dev/null | grep -E 'NFQUEUE' || true
+}
+masquerade_rules() {
+	in_router nft list ruleset 2>/dev/null | grep -E 'oifname "t0".*masquerade' || true
+	in_router iptables-save 2>/dev/null | grep -E -- '-o t0 .*MASQUERADE' || true
+}
+have_rule_tools() {
+	command -v nft >/dev/null || command -v iptables-save >/dev/null
+}
+
+# check_rules NAME present|absent
+check_rules() {
+	local rules
+	rules=$(${1}_rules)
+	if ! have_rule_tools; then
+		echo "SKIP: neither nft nor iptables-save found, $1 rules not checked"
+	elif [ "$2" = present ] && [ -z "$rules" ]; then
+		fail "no $1 rules while dnsr is running"
+	elif [ "$2" = absent ] && [ -n "$rules" ]; then
+		fail "$1 rules left: $rules"
+	else
+		pass "$1 rules $2"
+	fi
+}
+
+###############################################################################
+
+echo "Building..."
+go build -o "$WORK/dnsr" .
+go build -o "$WORK/stubdns" ./test/stubdns
+
+echo "Creating namespaces..."
+for ns in $CLIENT $ROUTER $UPSTREAM; do
+	ip netns del $ns 2>/dev/null || true
+	ip netns add $ns
+	ip -n $ns link set lo up
+done
+
+ip link add c0 netns $CLIENT type veth peer name r0 netns $ROUTER
+ip link add r1 netns $ROUTER type veth peer name u0 netns $UPSTREAM
+ip link add t0 netns $ROUTER type veth peer name t1 netns $UPSTREAM
+
+ip -n $CLIENT addr add 10.99.1.2/24 dev c0
+ip -n $ROUTER addr add 10.99.1.1/24 dev r0
+ip -n $ROUTER addr add 10.99.2.1/24 dev r1
+ip -n $ROUTER addr add 10.99.3.1/24 dev t0
+ip -n $UPSTREAM addr add 10.99.2.2/24 dev u0
+ip -n $UPSTREAM addr add 10.99.3.2/24 dev t1
+for link in "$CLIENT c0" "$ROUTER r0" "$ROUTER r1" "$ROUTER t0" "$UPSTREAM u0" "$UPSTREAM t1"; do
+	set -- $link
+	ip -n "$1" link set "$2" up
+done
+ip -n $CLIENT route add default via 10.99.1.1
+ip -n $ROUTER route add default via 10.99.2.2
+ip -n $UPSTREAM route add 10.99.1.0/24 via 10.99.2.1
+
+in_upstream "$WORK/stubdns" serve $DNS \
+	proxied.test=$PROXIED_IP blocked.test=$BLOCKED_IP direct.test=$DIRECT_IP &
+STUB_PID=$!
+
+echo "proxied.test" >"$WORK/proxy.lst"
+echo "blocked.test" >"$WORK/blocks.lst"
+
+echo "Starting dnsr..."
+in_router "$WORK/dnsr" --interface t0 \
+	--proxy-list "$WORK/proxy.lst" --block-list "$WORK/blocks.lst" \
+	--preset-ips /dev/null --control "$WORK/dnsr.sock" --verbose \
+	>"$WORK/dnsr.log" 2>&1 &
+DNSR_PID=$!
+for _ in $(seq 50); do
+	[ -S "$WORK/dnsr.sock" ] && break
+	sleep 0.1
+done
+if [ ! -S "$WORK/dnsr.sock" ]; then
+	cat "$WORK/dnsr.log"
+	echo "FAIL: dnsr didn't start"
+	exit 1
+fi
+
+###############################################################################
+
+check_rules queue present
+check_rules masquerade present
+
+if answer=$(in_client "$WORK/stubdns" query $DNS proxied.test) && [ "$answer" = $PROXIED_IP ]; then
+	pass "proxied name resolved"
+else
+	fail "proxied name not resolved: $answer"
+fi
+sleep 0.5
+if in_router ip route show $PROXIED_IP | grep -q "dev t0"; then
+	pass "route created for proxied name"
+else
+	fail "no route for proxied name"
+fi
+
+if in_client "$WORK/stubdns" query $DNS blocked.test 2>/dev/null; then
+	fail "blocked name resolved"
+else
+	pass "blocked name dropped"
+fi
+
+if answer=$(in_client "$WORK/stubdns" query $DNS direct.test) && [ "$answer" = $DIRECT_IP ]; then
+	pass "direct name resolved"
+else
+	fail "direct name not resolved: $answer"
+fi
+if in_router ip route show $DIRECT_IP | grep -q "dev t0"; then
+	fail "route created for direct name"
+else
+	pass "no route for direct name"
+fi
+
+if in_router "$WORK/dnsr" why --control "$WORK/dnsr.sock" $PROXIED_IP | grep -q proxied.test; then
+	pass "why shows domain of the route"
+else
+	fail "why doesn't show domain of the route"
+fi
+
+###############################################################################
+
+echo "Stopping dnsr..."
+kill "$DNSR_PID"
+wait "$DNSR_PID" || true
+DNSR_PID=
+
+if [ -n "$(in_router ip route show dev t0 | grep -v 'proto kernel')" ]; then
+	fail "routes left: $(in_router ip route show dev t0)"
+else
+	pass "routes removed"
+fi
+check_rules queue absent
+check_rules masquerade absent
+if in_router ip link show dnsr-wg >/dev/null 2>&1; then
+	fail "interface left"
+else
+	pass "no interface left"
+fi
+if [ -e "$WORK/dnsr.sock" ]; then
+	fail "control socket left"
+else
+	pass "control socket removed"
+fi
+
+###############################################################################
+
+# Same router, but dnsr runs in the current namespace and switches to it itself
+echo "Starting dnsr with --netns..."
+"$WORK/dnsr" --netns $ROUTER --interface t0 --proxy-list "$WORK/proxy.lst" \
+	--preset-ips /dev/null --control "$WORK/dnsr.sock" --verbose \
+	>>"$WORK/dnsr.log" 2>&1 &
+DNSR_PID=$!
+for _ in $(seq 50); do
+	[ -S "$WORK/dnsr.sock" ] && break
+	sleep 0.1
+done
+
+check_rules queue present
+if answer=$(in_client "$WORK/stubdns" query $DNS proxied.test) && [ "$answer" = $PROXIED_IP ]; then
+	sleep 0.5
+	if in_router ip route show $PROXIED_IP | grep -q "dev t0"; then
+		pass "route created in --netns"
+	else
+		fail "no route in --netns"
+	fi
+else
+	fail "proxied name not resolved with --netns: $answer"
+fi
+
+kill "$DNSR_PID"
+wait "$DNSR_PID" || true
+DNSR_PID=
+if [ -n "$(in_router ip route show dev t0 | grep -v 'proto kernel')" ]; then
+	fail "routes left in --netns: $(in_router ip route show dev t0)"
+else
+	pass "routes removed in --netns"
+fi
+check_rules queue absent
+check_rules masquerade absent
+
+###############################################################################
+
+echo "Starting dnsr in dnstap mode..."
+in_router "$WORK/dnsr" --interface t0 --proxy-list "$WORK/proxy.lst" \
+	--preset-ips /dev/null --control "" --dnstap "$WORK/dnstap.sock" --verbose \
+	>>"$WORK/dnsr.log" 2>&1 &
+DNSR_PID=$!
+for _ in $(seq 50); do
+	[ -S "$WORK/dnstap.sock" ] && break
+	sleep 0.1
+done
+
+if [ "$(stat -c %a "$WORK/dnstap.sock" 2>/dev/null)" = 660 ]; then
+	pass "dnstap socket is not world-writable"
+else
+	fail "dnstap socket mode: $(stat -c %a "$WORK/dnstap.sock" 2>&1)"
+fi
+if in_router "$WORK/stubdns" dnstap "$WORK/dnstap.sock" proxied.test=$DNSTAP_IP; then
+	sleep 0.5
+	if in_router ip route show $DNSTAP_IP | grep -q "dev t0"; then
+		pass "route created for proxied name from dnstap"
+	else
+		fail "no route for proxied name from dnstap"
+	fi
+else
+	fail "can't write to dnstap socket"
+fi
+
+kill "$DNSR_PID"
+wait "$DNSR_PID" || true
+DNSR_PID=
+if in_router ip route show $DNSTAP_IP | grep -q "dev t0"; then
+	fail "dnstap route left"
+else
+	pass "dnstap route removed"
+fi
+
+if [ $FAILED -ne 0 ]; then
+	echo "dnsr log:"
+	cat "$WORK/dnsr.log"
+	exit 1
+fi
+echo "All tests passed"
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// writeDnstap sends CLIENT_RESPONSE for every record over bidirectional
+// Frame Streams session
+func writeDnstap(socket string, records []string) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeControl(conn, 0x04, dnstapContentType) // READY
+	if control := readControl(conn); control != 0x01 {
+		log.Fatalf("expected ACCEPT, got %d", control)
+	}
+	writeControl(conn, 0x02, dnstapContentType) // START
+
+	for name, ip := range parseZone(records) {
+		query := newQuery(strings.TrimSuffix(name, "."))
+		response, err := answer(query, map[string]net.IP{name: ip})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		var message []byte
+		message = protowire.AppendTag(message, 1, protowire.VarintType)
+		message = protowire.AppendVarint(message, 6) // CLIENT_RESPONSE
+		message = protowire.AppendTag(message, 4, protowire.BytesType)
+		message = protowire.AppendBytes(message, net.IPv4(127, 0, 0, 1).To4())
+		message = protowire.AppendTag(message, 14, protowire.BytesType)
+		message = protowire.AppendBytes(message, response)
+
+		var frame []byte
+		frame = protowire.AppendTag(frame, 14, protowire.BytesType)
+		frame = protowire.AppendBytes(frame, message)
+		frame = protowire.AppendTag(frame, 15, protowire.VarintType)
+		frame = protowire.AppendVarint(frame, 1) // MESSAGE
+
+		conn.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame))))
+		conn.Write(frame)
+	}
+
+	writeControl(conn, 0x03, "") // STOP
+	if control := readControl(conn); control != 0x05 {
+		log.Fatalf("expected FINISH, got %d", control)
+	}
+}
+
+func writeControl(w io.Writer, control uint32, contentType string) {
+	frame := binary.BigEndian.AppendUint32(nil, control)
+	if contentType != "" {
+		frame = binary.BigEndian.AppendUint32(frame, 1)
+		frame = binary.BigEndian.AppendUint32(frame, uint32(len(contentType)))
+		frame = append(frame, contentType...)
+	}
+	header := binary.BigEndian.AppendUint32(nil, 0)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(frame)))
+	if _, err := w.Write(append(header, frame...)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readControl(r io.Reader) uint32 {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		log.Fatal(err)
+	}
+	frame := make([]byte, binary.BigEndian.Uint32(header[4:]))
+	if _, err := io.ReadFull(r, frame); err != nil {
+		log.Fatal(err)
+	}
+	return binary.BigEndian.Uint32(frame)
+}
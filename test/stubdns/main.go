@@ -0,0 +1,152 @@
+// stubdns is an authoritative DNS server, client and dnstap writer for the
+// end-to-end test.
+//
+//	stubdns serve 10.0.0.1:53 name=1.2.3.4 other=5.6.7.8
+//	stubdns query 10.0.0.1:53 name
+//	stubdns dnstap /run/dnstap.sock name=1.2.3.4
+//
+// Server answers A queries for the given names, NXDOMAIN for others. Client
+// prints answer IPs and fails if there is no answer in time. dnstap writer
+// sends client responses for the given names, as resolver would.
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const ttl = 60
+
+func main() {
+	if len(os.Args) < 3 {
+		log.Fatal("usage: stubdns serve ADDR NAME=IP... | stubdns query ADDR NAME | stubdns dnstap SOCKET NAME=IP...")
+	}
+	switch os.Args[1] {
+	case "serve":
+		serve(os.Args[2], os.Args[3:])
+	case "query":
+		if len(os.Args) != 4 {
+			log.Fatal("usage: stubdns query ADDR NAME")
+		}
+		query(os.Args[2], os.Args[3])
+	case "dnstap":
+		writeDnstap(os.Args[2], os.Args[3:])
+	default:
+		log.Fatalf("unknown mode: %s", os.Args[1])
+	}
+}
+
+func parseZone(records []string) map[string]net.IP {
+	zone := make(map[string]net.IP)
+	for _, record := range records {
+		name, ip, found := strings.Cut(record, "=")
+		if !found || net.ParseIP(ip).To4() == nil {
+			log.Fatalf("bad record: %s", record)
+		}
+		zone[strings.TrimSuffix(name, ".")+"."] = net.ParseIP(ip).To4()
+	}
+	return zone
+}
+
+func serve(addr string, records []string) {
+	zone := parseZone(records)
+
+	conn, err := net.ListenPacket("udp4", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	for {
+		n, client, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Fatal(err)
+		}
+		answer, err := answer(buf[:n], zone)
+		if err != nil {
+			log.Printf("bad query from %s: %v", client, err)
+			continue
+		}
+		conn.WriteTo(answer, client)
+	}
+}
+
+func answer(query []byte, zone map[string]net.IP) ([]byte, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	if len(msg.Questions) != 1 {
+		return nil, fmt.Errorf("%d questions", len(msg.Questions))
+	}
+	q := msg.Questions[0]
+	msg.Header.Response = true
+	msg.Header.Authoritative = true
+	msg.Answers = nil
+
+	ip, exists := zone[strings.ToLower(q.Name.String())]
+	switch {
+	case !exists:
+		msg.Header.RCode = dnsmessage.RCodeNameError
+	case q.Type == dnsmessage.TypeA:
+		var a dnsmessage.AResource
+		copy(a.A[:], ip)
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &a,
+		})
+	}
+	return msg.Pack()
+}
+
+func query(addr, name string) {
+	packet := newQuery(name)
+	conn, err := net.Dial("udp4", addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(packet); err != nil {
+		log.Fatal(err)
+	}
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var reply dnsmessage.Message
+	if err := reply.Unpack(buf[:n]); err != nil {
+		log.Fatal(err)
+	}
+	if reply.Header.RCode != dnsmessage.RCodeSuccess {
+		log.Fatalf("%s: %s", name, reply.Header.RCode)
+	}
+	for _, rr := range reply.Answers {
+		if a, ok := rr.Body.(*dnsmessage.AResource); ok {
+			fmt.Println(net.IP(a.A[:]))
+		}
+	}
+}
+
+func newQuery(name string) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(time.Now().UnixNano()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(strings.TrimSuffix(name, ".") + "."),
+			Type:  dnsmessage.TypeA,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	packet, err := msg.Pack()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return packet
+}
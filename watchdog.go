@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// If packets stop being processed, every DNS answer on the machine waits in the
+// queue and LAN goes offline. Watchdog removes queue rules in this case and puts
+// them back once processing resumes. Rules are installed with bypass flag too,
+// so kernel accepts packets when dnsr is dead.
+
+var (
+	// Packets received from kernel, but not processed by worker yet
+	pendingPackets atomic.Int64
+	// Unix nanoseconds of the last processed packet
+	lastProgress atomic.Int64
+
+	queueRulesMu        sync.Mutex
+	queueRulesInstalled bool
+	// Queue range of installed rules. Removal uses it, not --queues, which
+	// can differ for rules left by another run
+	queueFirst, queueCount uint16
+
+	watchdogStop chan struct{}
+)
+
+func installQueueRules() error {
+	queueRulesMu.Lock()
+	defer queueRulesMu.Unlock()
+	if err := firewall.InstallQueue(NFQUEUE, uint16(args.Queues)); err != nil {
+		return err
+	}
+	queueFirst, queueCount = NFQUEUE, uint16(args.Queues)
+	queueRulesInstalled = true
+	return nil
+}
+
+func startWatchdog() {
+	if args.Watchdog <= 0 {
+		return
+	}
+	lastProgress.Store(time.Now().UnixNano())
+	watchdogStop = make(chan struct{})
+	go func(stop <-chan struct{}) {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				checkProgress()
+			}
+		}
+	}(watchdogStop)
+}
+
+func stopWatchdog() {
+	queueRulesMu.Lock()
+	defer queueRulesMu.Unlock()
+	if watchdogStop != nil {
+		close(watchdogStop)
+		watchdogStop = nil
+	}
+}
+
+func checkProgress() {
+	stalled := pendingPackets.Load() > 0 &&
+		time.Since(time.Unix(0, lastProgress.Load())) > args.Watchdog
+
+	queueRulesMu.Lock()
+	defer queueRulesMu.Unlock()
+	// Tick which was waiting for the lock while rules were removed on exit
+	if watchdogStop == nil {
+		return
+	}
+	if stalled && queueRulesInstalled {
+		slog.Error(red("DNS answers are not processed, removing NFQUEUE rules"),
+			"pending", pendingPackets.Load(), "timeout", args.Watchdog)
+		if err := firewall.RemoveQueue(queueFirst, queueCount); err != nil {
+			slog.Error("Can't remove NFQUEUE rules", "err", err)
+			return
+		}
+		queueRulesInstalled = false
+	} else if !stalled && !queueRulesInstalled {
+		slog.Info(green("DNS answers processing resumed, restoring NFQUEUE rules"))
+		if err := firewall.InstallQueue(queueFirst, queueCount); err != nil {
+			slog.Error("Can't install NFQUEUE rules", "err", err)
+			return
+		}
+		queueRulesInstalled = true
+	}
+}
@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/vishvananda/netlink"
 	"golang.zx2c4.com/wireguard/wgctrl"
@@ -28,6 +30,22 @@ type PeerConfig struct {
 	PresharedKey string
 }
 
+// Peer endpoint given by hostname, which must be re-resolved from time to time
+type watchedEndpoint struct {
+	publicKey wgtypes.Key
+	endpoint  string
+	addr      *net.UDPAddr
+}
+
+// WireGuard considers a session dead when there was no handshake for this long
+const staleHandshake = 3 * time.Minute
+
+var (
+	// Endpoint IPs must never be routed into the tunnel itself
+	wgEndpointIPs    = NewIPv4Set(64)
+	watchedEndpoints []watchedEndpoint
+)
+
 func setupWireguard() {
 	config, err := parseWGConfig(args.WGConfig)
 	if err != nil {
@@ -43,23 +61,25 @@ func setupWireguard() {
 	}
 
 	log.Printf(green("Interface `%s` successfully configured"), INTERFACE_NAME)
+
+	if len(watchedEndpoints) > 0 && args.EndpointRefresh > 0 {
+		go watchEndpoints()
+	}
 }
 
 func removeWireguard(force bool) {
 	if force || !args.Persistent {
 		// Remove MASQUERADE rule
-		if useNFT {
-			execCommand("nft delete table ip dnsr-nat")
-		} else {
-			execCommand(fmt.Sprintf("iptables -t nat -D POSTROUTING -o %s -j MASQUERADE", INTERFACE_NAME))
+		if err := firewall.RemoveMasquerade(INTERFACE_NAME); err != nil {
+			log.Fatal(red("Error: "), err)
 		}
-		err := netlink.LinkDel(link)
+		err := nl.LinkDel(link)
 		if err != nil {
 			log.Fatalf(red("Error:")+" deleting `%s` interface: %v", args.Interface, err)
 		}
-		log.Printf(green("Interface `%s` successfully removed"), INTERFACE_NAME)
+		slog.Info(green("Interface successfully removed"), "interface", INTERFACE_NAME)
 	} else {
-		fmt.Printf(yellow("WireGuard interface '%s' remains active.\n"), INTERFACE_NAME)
+		log.Printf(yellow("WireGuard interface '%s' remains active."), INTERFACE_NAME)
 	}
 }
 
@@ -184,13 +204,28 @@ func setupInterface(config *WireguardConfig) error {
 		LinkAttrs: attrs,
 		LinkType:  "wireguard",
 	}
-	if err := netlink.LinkAdd(link); err != nil {
+	// UDP socket of WireGuard stays in the namespace where interface was created
+	creator := nl
+	if args.NetnsKeepSocket {
+		creator = &netlink.Handle{}
+	}
+	if err := creator.LinkAdd(link); err != nil {
 		if !isModuleLoaded("wireguard") {
 			log.Print(red("wireguard module not loaded. Run:"))
 			log.Print(green("  modprobe wireguard"))
 		}
 		return fmt.Errorf("failed to create interface: %v", err)
 	}
+	if args.NetnsKeepSocket {
+		if err := netlink.LinkSetNsFd(link, int(targetNs)); err != nil {
+			return fmt.Errorf("failed to move interface to `%s`: %v", args.Netns, err)
+		}
+		// Index may change in the new namespace
+		var err error
+		if link, err = nl.LinkByName(INTERFACE_NAME); err != nil {
+			return fmt.Errorf("failed to find interface in `%s`: %v", args.Netns, err)
+		}
+	}
 
 	// Set IP address
 	if args.Verbose {
@@ -200,12 +235,12 @@ func setupInterface(config *WireguardConfig) error {
 	if err != nil {
 		return fmt.Errorf("failed to parse address: %v", err)
 	}
-	if err := netlink.AddrAdd(link, addr); err != nil {
+	if err := nl.AddrAdd(link, addr); err != nil {
 		return fmt.Errorf("failed to set address: %v", err)
 	}
 
 	// Create WireGuard client
-	wgClient, err := wgctrl.New()
+	wgClient, err := newWgClient()
 	if err != nil {
 		return fmt.Errorf("failed to create WireGuard client: %v", err)
 	}
@@ -250,6 +285,16 @@ func setupInterface(config *WireguardConfig) error {
 				return fmt.Errorf("failed to resolve endpoint for peer %d: %v", i+1, err)
 			}
 			peerConfig.Endpoint = endpoint
+			protectEndpoint(endpoint.IP)
+
+			host, _, _ := net.SplitHostPort(peer.Endpoint)
+			if net.ParseIP(host) == nil {
+				watchedEndpoints = append(watchedEndpoints, watchedEndpoint{
+					publicKey: pubKey,
+					endpoint:  peer.Endpoint,
+					addr:      endpoint,
+				})
+			}
 		}
 
 		if peer.PresharedKey != "" {
@@ -278,7 +323,7 @@ func setupInterface(config *WireguardConfig) error {
 	if args.Verbose {
 		log.Printf("Bringing up interface %s", INTERFACE_NAME)
 	}
-	if err := netlink.LinkSetUp(link); err != nil {
+	if err := nl.LinkSetUp(link); err != nil {
 		return fmt.Errorf("failed to bring up interface: %v", err)
 	}
 
@@ -307,6 +352,103 @@ func setupInterface(config *WireguardConfig) error {
 	return nil
 }
 
+// newWgClient opens wgctrl in --netns, where the interface is
+func newWgClient() (*wgctrl.Client, error) {
+	var wgClient *wgctrl.Client
+	err := inNetns(func() (err error) {
+		wgClient, err = wgctrl.New()
+		return err
+	})
+	return wgClient, err
+}
+
+// protectEndpoint excludes the peer address from proxy routes. Route to it through
+// the tunnel would make the tunnel unreachable.
+func protectEndpoint(ip net.IP) {
+	if ip.To4() == nil {
+		return
+	}
+	wgEndpointIPs.Add(ip)
+	rerouted := false
+	if proxyIPset.Remove(ip) {
+		log.Printf(yellow("Removing proxy route to WireGuard endpoint %s"), ip)
+		rerouted = delRoute(ip)
+	}
+	if presetNetsContain(ip) {
+		excludeFromPresetNets(ip)
+		rerouted = true
+	}
+	if rerouted {
+		router.FlushConntrack([]*net.IPNet{singleHostRoute(ip)})
+	}
+	if blockNetsContain(ip) || blackholeIPset.Exists(ip) {
+		protectEndpointBlackholes(ip)
+	}
+}
+
+func watchEndpoints() {
+	ticker := time.NewTicker(args.EndpointRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		refreshEndpoints()
+	}
+}
+
+// refreshEndpoints re-resolves hostname endpoints and updates peers whose
+// address changed and whose handshake is stale
+func refreshEndpoints() {
+	wgClient, err := newWgClient()
+	if err != nil {
+		log.Printf(red("Error:")+" creating WireGuard client: %v", err)
+		return
+	}
+	defer wgClient.Close()
+
+	device, err := wgClient.Device(INTERFACE_NAME)
+	if err != nil {
+		log.Printf(red("Error:")+" reading `%s` device: %v", INTERFACE_NAME, err)
+		return
+	}
+	handshakes := make(map[wgtypes.Key]time.Time)
+	for _, peer := range device.Peers {
+		handshakes[peer.PublicKey] = peer.LastHandshakeTime
+	}
+
+	for i := range watchedEndpoints {
+		ep := &watchedEndpoints[i]
+		addr, err := net.ResolveUDPAddr("udp", ep.endpoint)
+		if err != nil {
+			log.Printf(yellow("Can't resolve endpoint %s: ")+"%v", ep.endpoint, err)
+			continue
+		}
+		if addr.String() == ep.addr.String() {
+			continue
+		}
+		if time.Since(handshakes[ep.publicKey]) < staleHandshake {
+			if args.Verbose {
+				log.Printf("Endpoint %s changed to %s, but handshake is fresh", ep.endpoint, addr)
+			}
+			continue
+		}
+
+		protectEndpoint(addr.IP)
+		err = wgClient.ConfigureDevice(INTERFACE_NAME, wgtypes.Config{
+			Peers: []wgtypes.PeerConfig{{
+				PublicKey:  ep.publicKey,
+				UpdateOnly: true,
+				Endpoint:   addr,
+			}},
+		})
+		if err != nil {
+			log.Printf(red("Error:")+" updating endpoint %s: %v", ep.endpoint, err)
+			continue
+		}
+		slog.Info(green("Endpoint changed"), "endpoint", ep.endpoint, "old", ep.addr, "new", addr)
+		wgEndpointIPs.Remove(ep.addr.IP)
+		ep.addr = addr
+	}
+}
+
 func isModuleLoaded(moduleName string) bool {
 	content, err := os.ReadFile("/proc/modules")
 	if err != nil {
@@ -327,12 +469,7 @@ func isModuleLoaded(moduleName string) bool {
 ///////////////////////////////////////////////////////////////////////////////
 
 func setUpMasquerade(name string) {
-	if useNFT {
-		execCommand("nft add table dnsr-nat")
-		execCommand("nft add chain ip dnsr-nat postrouting { type nat hook postrouting priority 100 \\; }")
-		execCommand("nft add table dnsr-nat")
-		execCommand("nft add rule ip dnsr-nat postrouting oifname", name, "masquerade")
-	} else {
-		execCommand(fmt.Sprintf("iptables -t nat -A POSTROUTING -o %s -j MASQUERADE", name))
+	if err := firewall.Masquerade(name); err != nil {
+		log.Fatal(red("Error: "), err)
 	}
 }